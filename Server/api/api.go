@@ -1,22 +1,32 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Labutin/KVServer/Server/api/persist"
 	"github.com/Labutin/KVServer/Server/logs"
 	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
 	"github.com/pressly/chi"
 	"github.com/pressly/chi/render"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	storage        *kvstorage.Storage
+	// currentStorage keeps *kvstorage.Storage which serves requests. Load in replace mode swaps it
+	currentStorage atomic.Value
+	// swapMutex is held for reading by requests which change storage and for writing while storage is swapped,
+	// so that no change is written to storage which is being replaced
+	swapMutex      sync.RWMutex
 	chuncks        uint32
 	urlPath        = "/v1/kvstorage"
+	adminPath      = "/v1/admin"
 	persistStorage persist.PersistStorage
 )
 
@@ -28,6 +38,15 @@ type Resp struct {
 	Error    string      `json:"error"`
 }
 
+// bindJSON decodes JSON request body like render.Bind but keeps numbers as json.Number,
+// so that integers are stored with exact value and type
+func bindJSON(body io.Reader, v interface{}) error {
+	defer io.Copy(ioutil.Discard, body)
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
 // handlerPing just ping pong
 func handlerPing(w http.ResponseWriter, _ *http.Request) {
 	fmt.Fprint(w, "pong")
@@ -41,7 +60,12 @@ func InitRouter() *chi.Mux {
 	})
 
 	r.Get("/v1/ping", handlerPing)
+	r.Get("/v1/ready", handlerReady)
 	r.Route(urlPath, func(r chi.Router) {
+		r.Use(requireReady)
+		r.Use(holdStorage)
+		r.Use(countWrites)
+		r.Use(writeChanges)
 		r.Route("/get/:key", func(r chi.Router) {
 			r.Get("/", getRecord)
 		})
@@ -58,23 +82,142 @@ func InitRouter() *chi.Mux {
 		})
 		r.Post("/dict/", addDict)
 		r.Post("/list/", addList)
+		r.Post("/bitmap/", addBitmap)
+		r.Post("/bitmap/:key", addBitmap)
+		r.Get("/bitmap/:key", getBitmap)
+		r.Post("/setbit/", setBit)
+		r.Get("/getbit/:key/:offset", getBit)
+		r.Get("/bitcount/:key", bitCount)
+		r.Get("/bitpos/:key/:bit", bitPos)
+		r.Post("/bitop/", bitOp)
+		r.Post("/geo/", addGeo)
+		r.Delete("/geo/", removeGeo)
+		r.Get("/geopos/:key/:member", getGeoPos)
+		r.Get("/geodist/:key/:member1/:member2", getGeoDist)
+		r.Get("/georadius/:key", geoRadius)
+		r.Get("/geobox/:key", geoBox)
+		r.Post("/stream/", addStreamEntry)
+		r.Get("/xrange/:key", getStreamRange)
+		r.Get("/xread/:key", readStream)
+		r.Post("/xtrim/", trimStream)
+		r.Post("/xgroup/", addStreamGroup)
+		r.Delete("/xgroup/", removeStreamGroup)
+		r.Post("/xreadgroup/", readStreamGroup)
+		r.Post("/xack/", ackStreamEntries)
+		r.Get("/xpending/:key/:group", getStreamPending)
+		r.Get("/doc/:key", getDocument)
+		r.Patch("/doc/:key", patchDocument)
 		r.Get("/keys", getAllKeys)
 		r.Get("/saveToDb", saveToDb)
 		r.Get("/loadFromDb", loadFromDb)
 	})
+	r.Route(adminPath, func(r chi.Router) {
+		r.Get("/autosave", getAutosaveStatus)
+		r.Get("/persist", getPersistModeStatus)
+		r.Get("/persist/health", getPersistHealth)
+		r.Get("/compression", getCompressionStats)
+		r.Get("/jobs", getJobs)
+		r.Get("/snapshots", getSnapshots)
+		r.Get("/jobs/:id", getJob)
+		r.Delete("/jobs/:id", cancelJob)
+		r.Get("/export", exportData)
+		r.Get("/schemas", getSchemas)
+		// Data and schemas are not changed or saved until they are loaded on start
+		r.Group(func(r chi.Router) {
+			r.Use(requireReady)
+			r.Post("/jobs/save", startSaveJob)
+			r.Post("/jobs/load", startLoadJob)
+			r.Post("/jobs/reencrypt", startReencryptJob)
+			r.Post("/snapshots/:id/restore", startRestoreJob)
+			r.Post("/import", importData)
+			r.Post("/schemas/", addSchema)
+			r.Delete("/schemas/", removeSchema)
+		})
+	})
 
 	return r
 }
 
 // InitStorage creates Key/Value storage
 func InitStorage(totalChunks uint32) {
-	storage = kvstorage.NewKVStorage(totalChunks, true)
 	chuncks = totalChunks
+	useStorage(kvstorage.NewKVStorage(totalChunks, true))
+}
+
+// getStorage returns storage which serves requests
+func getStorage() *kvstorage.Storage {
+	storage, _ := currentStorage.Load().(*kvstorage.Storage)
+	return storage
+}
+
+// useStorage makes given storage current. Expiration of records in previous storage is stopped
+func useStorage(newStorage *kvstorage.Storage) {
+	previous := getStorage()
+	currentStorage.Store(newStorage)
+	swappedMutex.Lock()
+	close(swapped)
+	swapped = make(chan struct{})
+	swappedMutex.Unlock()
+	attachChangeLogger()
+	writes.attach(newStorage)
+	cache.attach(newStorage)
+	memoryCompression.attach(newStorage)
+	trackChanges(newStorage)
+	if previous != nil {
+		previous.StopTTLProcessing()
+	}
+}
+
+var (
+	// swapped is closed when storage is swapped, so that requests waiting on previous storage switch to current one
+	swapped      = make(chan struct{})
+	swappedMutex sync.Mutex
+)
+
+// storageSwapped returns channel which is closed on next storage swap. It is taken before storage is read,
+// so that no swap is missed
+func storageSwapped() <-chan struct{} {
+	swappedMutex.Lock()
+	defer swappedMutex.Unlock()
+	return swapped
+}
+
+// holdStorage is middleware which keeps storage from being swapped while modifying request is served
+func holdStorage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		swapMutex.RLock()
+		defer swapMutex.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// releaseStorage lets storage be swapped while request waits (e.g. for stream entries).
+// Storage must be taken by getStorage again after wait
+func releaseStorage(r *http.Request, wait func()) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		wait()
+		return
+	}
+	swapMutex.RUnlock()
+	defer swapMutex.RLock()
+	wait()
 }
 
 // InitPersistentStorage sets MongoDb params
 func InitPersistentStorage(pStorage persist.PersistStorage) {
 	persistStorage = pStorage
+	attachChangeLogger()
+}
+
+// attachChangeLogger makes persistent storage which logs every change (e.g. append only file) follow current storage
+func attachChangeLogger() {
+	if logger, ok := persistStorage.(persist.ChangeLogger); ok && getStorage() != nil {
+		logger.Attach(getStorage())
+	}
 }
 
 // addRecord puts record to storage
@@ -84,13 +227,16 @@ func addRecord(w http.ResponseWriter, r *http.Request) {
 		Value interface{} `json:"value"`
 		TTL   int64       `json:"ttl"`
 	}
-	if err := render.Bind(r.Body, &data); err != nil {
+	if err := bindJSON(r.Body, &data); err != nil {
 		render.Status(r, http.StatusNotAcceptable)
 		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
 		return
 	}
+	if !validateValue(w, r, data.Key, data.Value) {
+		return
+	}
 	ttl := time.Second * time.Duration(data.TTL)
-	storage.Set(data.Key, data.Value, ttl)
+	getStorage().Set(data.Key, data.Value, ttl)
 	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Added record with key: "+data.Key, nil))
 	render.JSON(w, r, Resp{Response: "", Ok: true})
 }
@@ -102,27 +248,30 @@ func updateRecord(w http.ResponseWriter, r *http.Request) {
 		Value interface{} `json:"value"`
 		TTL   int64       `json:"ttl"`
 	}
-	if err := render.Bind(r.Body, &data); err != nil {
+	if err := bindJSON(r.Body, &data); err != nil {
 		render.Status(r, http.StatusNotAcceptable)
 		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
 		return
 	}
+	if !validateValue(w, r, data.Key, data.Value) {
+		return
+	}
 	ttl := time.Second * time.Duration(data.TTL)
-	storage.Update(data.Key, data.Value, ttl)
+	getStorage().Update(data.Key, data.Value, ttl)
 	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Updated record with key: "+data.Key, nil))
 	render.JSON(w, r, Resp{Response: "", Ok: true})
 }
 
 // getAllKeys returns all keys in storage
 func getAllKeys(w http.ResponseWriter, r *http.Request) {
-	render.JSON(w, r, Resp{Response: storage.Keys(), Ok: true})
+	render.JSON(w, r, Resp{Response: getStorage().Keys(), Ok: true})
 }
 
 // getRecord returns record from storage
 func getRecord(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	var res Resp
-	if value, ok := storage.Get(key); !ok {
+	if value, ok := getStorage().Get(key); !ok {
 		render.Status(r, http.StatusNotFound)
 		res.Ok = false
 		res.Error = KeyNotFound.String()
@@ -138,12 +287,12 @@ func removeRecord(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Key string `json:"key"`
 	}
-	if err := render.Bind(r.Body, &data); err != nil {
+	if err := bindJSON(r.Body, &data); err != nil {
 		render.Status(r, http.StatusNotAcceptable)
 		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
 		return
 	}
-	storage.Remove(data.Key)
+	getStorage().Remove(data.Key)
 	render.JSON(w, r, Resp{Response: "", Ok: true})
 }
 
@@ -154,13 +303,16 @@ func addDict(w http.ResponseWriter, r *http.Request) {
 		Value map[string]interface{} `json:"value"`
 		TTL   int64                  `json:"ttl"`
 	}
-	if err := render.Bind(r.Body, &data); err != nil {
+	if err := bindJSON(r.Body, &data); err != nil {
 		render.Status(r, http.StatusNotAcceptable)
 		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
 		return
 	}
+	if !validateValue(w, r, data.Key, data.Value) {
+		return
+	}
 	ttl := time.Second * time.Duration(data.TTL)
-	storage.Set(data.Key, data.Value, ttl)
+	getStorage().Set(data.Key, data.Value, ttl)
 	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Added dictionary with key: "+data.Key, nil))
 	render.JSON(w, r, Resp{Response: "", Ok: true})
 }
@@ -170,7 +322,7 @@ func getDictRecord(w http.ResponseWriter, r *http.Request) {
 	key := chi.URLParam(r, "key")
 	dictKey := chi.URLParam(r, "keydict")
 	var res Resp
-	if value, err := storage.GetDictElement(key, dictKey); err != nil {
+	if value, err := getStorage().GetDictElement(key, dictKey); err != nil {
 		render.Status(r, http.StatusNotFound)
 		res.Ok = false
 		res.Error = err.Error()
@@ -188,13 +340,16 @@ func addList(w http.ResponseWriter, r *http.Request) {
 		Value []interface{} `json:"value"`
 		TTL   int64         `json:"ttl"`
 	}
-	if err := render.Bind(r.Body, &data); err != nil {
+	if err := bindJSON(r.Body, &data); err != nil {
 		render.Status(r, http.StatusNotAcceptable)
 		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
 		return
 	}
+	if !validateValue(w, r, data.Key, data.Value) {
+		return
+	}
 	ttl := time.Second * time.Duration(data.TTL)
-	storage.Set(data.Key, data.Value, ttl)
+	getStorage().Set(data.Key, data.Value, ttl)
 	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Added list with key: "+data.Key, nil))
 	render.JSON(w, r, Resp{Response: "", Ok: true})
 }
@@ -205,7 +360,7 @@ func getListRecord(w http.ResponseWriter, r *http.Request) {
 	index := chi.URLParam(r, "index")
 	indexInt, _ := strconv.Atoi(index)
 	var res Resp
-	if value, err := storage.GetListElement(key, indexInt); err != nil {
+	if value, err := getStorage().GetListElement(key, indexInt); err != nil {
 		render.Status(r, http.StatusNotFound)
 		res.Ok = false
 		res.Error = err.Error()
@@ -216,12 +371,16 @@ func getListRecord(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, res)
 }
 
-// saveToDb store all data to MongoDB
+// saveToDb store all data to MongoDB. With 'mode=incremental' query parameter only changes since previous save are stored
 func saveToDb(w http.ResponseWriter, r *http.Request) {
-	err := persistStorage.SaveToDb(storage)
+	err := snapshots.save(r.URL.Query().Get("mode") == "incremental")
 	var res Resp
 	if err != nil {
-		render.Status(r, http.StatusInternalServerError)
+		if err == SaveInProgress {
+			render.Status(r, http.StatusConflict)
+		} else {
+			render.Status(r, http.StatusInternalServerError)
+		}
 		res.Ok = false
 		res.Error = err.Error()
 		render.JSON(w, r, res)
@@ -232,14 +391,24 @@ func saveToDb(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, res)
 }
 
-// saveToDb restore all data from MongoDB
+// loadFromDb restores data from persistent storage. Mode (replace by default, merge or merge-keep)
+// and key prefix are given in query
 func loadFromDb(w http.ResponseWriter, r *http.Request) {
-	storage.StopTTLProcessing()
-	InitStorage(chuncks)
-	err := persistStorage.LoadFromDb(storage)
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = LOAD_MODE_REPLACE
+	}
+	err := Load(mode, r.URL.Query().Get("prefix"))
 	var res Resp
 	if err != nil {
-		render.Status(r, http.StatusInternalServerError)
+		switch err {
+		case UnknownLoadMode:
+			render.Status(r, http.StatusBadRequest)
+		case LoadInProgress:
+			render.Status(r, http.StatusConflict)
+		default:
+			render.Status(r, http.StatusInternalServerError)
+		}
 		res.Ok = false
 		res.Error = err.Error()
 		render.JSON(w, r, res)
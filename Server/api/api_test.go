@@ -2,7 +2,10 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"github.com/Labutin/KVServer/Server/api/persist"
 	"github.com/Labutin/KVServer/Server/logs"
 	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
 	"github.com/hashicorp/logutils"
@@ -14,8 +17,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -25,28 +33,79 @@ var (
 
 type MockPersistStorage struct {
 	mock.Mock
+	schemas    map[string]interface{}
+	schemasErr error
+	data       map[string]interface{}
+	// onLoad is called while data is loaded
+	onLoad func()
 }
 
-func (t MockPersistStorage) SaveToDb(storage *kvstorage.Storage) error {
+func (t *MockPersistStorage) SaveToDb(storage *kvstorage.Storage) error {
 	t.Called()
 	return nil
 }
 
-func (t MockPersistStorage) LoadFromDb(storage *kvstorage.Storage) error {
+func (t *MockPersistStorage) SaveChangesToDb(storage *kvstorage.Storage) error {
 	t.Called()
+	storage.TakeDirty()
 	return nil
 }
 
+func (t *MockPersistStorage) SaveKeys(storage *kvstorage.Storage, keys []string) error {
+	sort.Strings(keys)
+	return t.Called(keys).Error(0)
+}
+
+func (t *MockPersistStorage) LoadKey(key string) (interface{}, int64, bool, error) {
+	args := t.Called(key)
+	return args.Get(0), args.Get(1).(int64), args.Bool(2), args.Error(3)
+}
+
+func (t *MockPersistStorage) LoadFromDb(storage *kvstorage.Storage) error {
+	t.Called()
+	for key, value := range t.data {
+		storage.Set(key, value, 0)
+	}
+	if t.onLoad != nil {
+		t.onLoad()
+	}
+	storage.TakeDirty()
+	return nil
+}
+
+func (t *MockPersistStorage) SaveSchemas(schemas map[string]interface{}) error {
+	if t.schemasErr != nil {
+		return t.schemasErr
+	}
+	t.schemas = schemas
+	return nil
+}
+
+func (t *MockPersistStorage) LoadSchemas() (map[string]interface{}, error) {
+	return t.schemas, nil
+}
+
 type testResponse struct {
 	responseCode int
 	response     Resp
 }
 
 type testRequest struct {
-	url      string
-	method   string
-	body     map[string]interface{}
-	response testResponse
+	url         string
+	method      string
+	body        map[string]interface{}
+	rawBody     interface{}
+	contentType string
+	response    testResponse
+}
+
+// requireSameJSON checks that values are encoded to the same JSON. Numbers written by API are json.Number
+func requireSameJSON(t *testing.T, expected, actual interface{}) {
+	expectedJSON, err := json.Marshal(expected)
+	require.NoError(t, err)
+	actualJSON, err := json.Marshal(actual)
+	require.NoError(t, err)
+	require.JSONEq(t, string(expectedJSON), string(actualJSON))
 }
 
 func TestPing(t *testing.T) {
@@ -88,6 +147,17 @@ func testRequests(t *testing.T, requests []testRequest) {
 			require.NoError(t, err)
 			resp, err := http.DefaultClient.Do(req)
 			checkRequest(t, testRequest, resp, err)
+		case http.MethodPatch:
+			body, err := json.Marshal(testRequest.body)
+			if testRequest.rawBody != nil {
+				body, err = json.Marshal(testRequest.rawBody)
+			}
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPatch, testRequest.url, bytes.NewBuffer(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", testRequest.contentType)
+			resp, err := http.DefaultClient.Do(req)
+			checkRequest(t, testRequest, resp, err)
 		case http.MethodDelete:
 			body, err := json.Marshal(testRequest.body)
 			require.NoError(t, err)
@@ -147,9 +217,9 @@ func TestDict(t *testing.T) {
 		},
 	}
 	testRequests(t, requests)
-	value, ok := storage.Get("dict")
+	value, ok := getStorage().Get("dict")
 	require.True(t, ok)
-	require.Equal(t, postBody["value"], value)
+	requireSameJSON(t, postBody["value"], value)
 }
 
 func TestList(t *testing.T) {
@@ -172,43 +242,727 @@ func TestList(t *testing.T) {
 			},
 		},
 		{
-			url:    server.URL + urlPath + "/getlist/list/1",
-			method: http.MethodGet,
+			url:    server.URL + urlPath + "/getlist/list/1",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: nestedList[1],
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/getlist/absentlist/0",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusNotFound,
+				response: Resp{
+					Error: KeyNotFound.String(),
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/getlist/list/100",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusNotFound,
+				response: Resp{
+					Error: "Out of bound",
+					Ok:    false,
+				},
+			},
+		},
+	}
+	testRequests(t, requests)
+	value, ok := getStorage().Get("list")
+	require.True(t, ok)
+	requireSameJSON(t, postBody["value"], value)
+}
+
+func TestBitmap(t *testing.T) {
+	postBody := map[string]interface{}{}
+	postBody["key"] = "bitmap1"
+	postBody["value"] = base64.StdEncoding.EncodeToString([]byte{0xF0})
+	setBitBody := map[string]interface{}{}
+	setBitBody["key"] = "bitmap2"
+	setBitBody["offset"] = 9
+	setBitBody["value"] = 1
+	bitOpBody := map[string]interface{}{}
+	bitOpBody["operation"] = "or"
+	bitOpBody["destkey"] = "bitmap3"
+	bitOpBody["keys"] = []string{"bitmap1", "bitmap2"}
+	requests := []testRequest{
+		{
+			url:    server.URL + urlPath + "/bitmap/",
+			method: http.MethodPost,
+			body:   postBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/setbit/",
+			method: http.MethodPost,
+			body:   setBitBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: float64(0),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/getbit/bitmap2/9",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: float64(1),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/bitcount/bitmap1",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: float64(4),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/bitpos/bitmap1/0",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: float64(4),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/bitop/",
+			method: http.MethodPost,
+			body:   bitOpBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: float64(2),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/bitmap/bitmap3",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: base64.StdEncoding.EncodeToString([]byte{0xF0, 0x40}),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/getbit/list/0",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusNotAcceptable,
+				response: Resp{
+					Error: NotBitmap.String(),
+					Ok:    false,
+				},
+			},
+		},
+	}
+	getStorage().Set("list", []interface{}{float64(1)}, 0)
+	testRequests(t, requests)
+
+	resp, err := http.Post(server.URL+urlPath+"/bitmap/raw", "application/octet-stream", bytes.NewBuffer([]byte{0x01, 0x02}))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	value, ok := getStorage().Get("raw")
+	require.True(t, ok)
+	require.Equal(t, []byte{0x01, 0x02}, value)
+}
+
+func TestGeo(t *testing.T) {
+	postBody := map[string]interface{}{}
+	postBody["key"] = "drivers"
+	postBody["members"] = []map[string]interface{}{
+		{"name": "Palermo", "lon": 13.361389, "lat": 38.115556},
+		{"name": "Catania", "lon": 15.087269, "lat": 37.502669},
+		{"name": "Rome", "lon": 12.496366, "lat": 41.902782},
+	}
+	requests := []testRequest{
+		{
+			url:    server.URL + urlPath + "/geo/",
+			method: http.MethodPost,
+			body:   postBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: float64(3),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/geo/",
+			method: http.MethodPost,
+			body:   map[string]interface{}{"key": "empty", "members": []interface{}{}},
+			response: testResponse{
+				responseCode: http.StatusNotAcceptable,
+				response: Resp{
+					Error: "No members to add",
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/geopos/drivers/absent",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusNotFound,
+				response: Resp{
+					Error: "Member not found",
+					Ok:    false,
+				},
+			},
+		},
+	}
+	testRequests(t, requests)
+
+	dist, err := getStorage().GeoDist("drivers", "Palermo", "Catania", "km")
+	require.NoError(t, err)
+	require.InDelta(t, 166.27, dist, 0.01)
+
+	resp, err := http.Get(server.URL + urlPath + "/georadius/drivers?lon=15&lat=37&radius=200&unit=km")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var radiusResp struct {
+		Response []kvstorage.GeoResult `json:"response"`
+		Ok       bool                  `json:"ok"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&radiusResp))
+	require.True(t, radiusResp.Ok)
+	require.Len(t, radiusResp.Response, 2)
+	require.Equal(t, "Catania", radiusResp.Response[0].Name)
+	require.Equal(t, "Palermo", radiusResp.Response[1].Name)
+
+	results, err := getStorage().GeoBox("drivers", 13, 40, 300, 600, "km", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "Palermo", results[0].Name)
+	require.Equal(t, "Rome", results[1].Name)
+}
+
+func TestStream(t *testing.T) {
+	groupBody := map[string]interface{}{}
+	groupBody["key"] = "events"
+	groupBody["group"] = "workers"
+	groupBody["start"] = "0"
+	addBody := map[string]interface{}{}
+	addBody["key"] = "events"
+	addBody["id"] = "1-1"
+	addBody["fields"] = map[string]interface{}{"type": "created"}
+	readGroupBody := map[string]interface{}{}
+	readGroupBody["key"] = "events"
+	readGroupBody["group"] = "workers"
+	readGroupBody["consumer"] = "c1"
+	ackBody := map[string]interface{}{}
+	ackBody["key"] = "events"
+	ackBody["group"] = "workers"
+	ackBody["ids"] = []string{"1-1"}
+	entry := map[string]interface{}{"id": "1-1", "fields": map[string]interface{}{"type": "created"}}
+	requests := []testRequest{
+		{
+			url:    server.URL + urlPath + "/xgroup/",
+			method: http.MethodPost,
+			body:   groupBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/stream/",
+			method: http.MethodPost,
+			body:   addBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "1-1",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/stream/",
+			method: http.MethodPost,
+			body:   addBody,
+			response: testResponse{
+				responseCode: http.StatusNotAcceptable,
+				response: Resp{
+					Error: "ID must be greater than last stream ID",
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/xrange/events?start=-&end=%2B",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: []interface{}{entry},
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/xreadgroup/",
+			method: http.MethodPost,
+			body:   readGroupBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: []interface{}{entry},
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/xack/",
+			method: http.MethodPost,
+			body:   ackBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: float64(1),
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/xpending/events/workers",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: []interface{}{},
+					Ok:       true,
+				},
+			},
+		},
+	}
+	testRequests(t, requests)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		getStorage().XAdd("events", "2-1", map[string]interface{}{"type": "updated"}, 0)
+	}()
+	entries, err := getStorage().XRead(context.Background(), "events", "1-1", 0, time.Second)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "2-1", entries[0].ID)
+
+	removed, err := getStorage().XTrim("events", 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+}
+
+func TestBlockingStreamSwap(t *testing.T) {
+	fillStream := func(storage *kvstorage.Storage) {
+		_, err := storage.XAdd("blocked", "1-1", map[string]interface{}{"n": "1"}, 0)
+		require.NoError(t, err)
+		require.NoError(t, storage.XGroupCreate("blocked", "g", kvstorage.StreamIDNew))
+	}
+	fillStream(getStorage())
+	read := func(request func() (*http.Response, error), result chan<- []interface{}) {
+		var res Resp
+		resp, err := request()
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&res)
+			resp.Body.Close()
+		}
+		entries, _ := res.Response.([]interface{})
+		result <- entries
+	}
+	groupResult := make(chan []interface{}, 1)
+	go read(func() (*http.Response, error) {
+		body := `{"key":"blocked","group":"g","consumer":"c","block":5000}`
+		return http.Post(server.URL+urlPath+"/xreadgroup/", "application/json", strings.NewReader(body))
+	}, groupResult)
+	readResult := make(chan []interface{}, 1)
+	go read(func() (*http.Response, error) {
+		return http.Get(server.URL + urlPath + "/xread/blocked?block=5000")
+	}, readResult)
+	time.Sleep(100 * time.Millisecond)
+
+	// Blocked reads don't keep storage from being swapped and wait for entries of storage which replaced it
+	started := time.Now()
+	require.NoError(t, restore(context.Background(), LOAD_MODE_REPLACE, "", func(ctx context.Context, loaded *kvstorage.Storage) error {
+		fillStream(loaded)
+		return nil
+	}))
+	require.True(t, time.Since(started) < time.Second)
+	_, err := getStorage().XAdd("blocked", "2-1", map[string]interface{}{"n": "2"}, 0)
+	require.NoError(t, err)
+	entry := map[string]interface{}{"id": "2-1", "fields": map[string]interface{}{"n": "2"}}
+	require.Equal(t, []interface{}{entry}, <-groupResult)
+	require.Equal(t, []interface{}{entry}, <-readResult)
+	pending, err := getStorage().XPending("blocked", "g", "c")
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	getStorage().Remove("blocked")
+}
+
+func TestDocument(t *testing.T) {
+	document := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{float64(0), float64(1), float64(2), map[string]interface{}{"c": "d"}},
+		},
+		"e": "f",
+	}
+	getStorage().Set("doc", document, 0)
+	requests := []testRequest{
+		{
+			url:    server.URL + urlPath + "/doc/doc?path=$.a.b[3].c",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "d",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/doc/doc?path=$.a.b[-1].c",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "d",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/doc/doc?path=$.a.x",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusNotFound,
+				response: Resp{
+					Error: "Path not found",
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/doc/doc",
+			method: http.MethodPatch,
+			rawBody: []map[string]interface{}{
+				{"op": "replace", "path": "/e", "value": "g"},
+				{"op": "test", "path": "/a/b/0", "value": float64(100)},
+			},
+			contentType: "application/json-patch+json",
+			response: testResponse{
+				responseCode: http.StatusConflict,
+				response: Resp{
+					Error: "Test operation failed for path /a/b/0",
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/doc/doc",
+			method: http.MethodPatch,
+			rawBody: []map[string]interface{}{
+				{"op": "remove", "path": "/a/b/-1"},
+			},
+			contentType: "application/json-patch+json",
+			response: testResponse{
+				responseCode: http.StatusConflict,
+				response: Resp{
+					Error: "Invalid list index",
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/doc/doc",
+			method: http.MethodPatch,
+			rawBody: []map[string]interface{}{
+				{"op": "replace", "path": "/a/b/01", "value": "x"},
+			},
+			contentType: "application/json-patch+json",
+			response: testResponse{
+				responseCode: http.StatusConflict,
+				response: Resp{
+					Error: "Invalid list index",
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/doc/doc",
+			method: http.MethodPatch,
+			rawBody: []map[string]interface{}{
+				{"op": "test", "path": "/a/b/0", "value": float64(0)},
+				{"op": "remove", "path": "/a/b/1"},
+				{"op": "add", "path": "/a/b/-", "value": "last"},
+				{"op": "move", "from": "/e", "path": "/a/e"},
+			},
+			contentType: "application/json-patch+json",
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:         server.URL + urlPath + "/doc/doc",
+			method:      http.MethodPatch,
+			rawBody:     map[string]interface{}{"a": map[string]interface{}{"e": nil}, "h": "i"},
+			contentType: "application/merge-patch+json",
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/doc/doc",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: map[string]interface{}{
+						"a": map[string]interface{}{
+							"b": []interface{}{float64(0), float64(2), map[string]interface{}{"c": "d"}, "last"},
+						},
+						"h": "i",
+					},
+					Ok: true,
+				},
+			},
+		},
+	}
+	testRequests(t, requests)
+	require.Equal(t, "f", document["e"])
+}
+
+func TestSchema(t *testing.T) {
+	schemaBody := map[string]interface{}{}
+	schemaBody["prefix"] = "user:"
+	schemaBody["schema"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"name"},
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string", "minLength": 1},
+			"age":  map[string]interface{}{"type": "integer", "minimum": 0},
+		},
+		"additionalProperties": false,
+	}
+	validBody := map[string]interface{}{}
+	validBody["key"] = "user:1"
+	validBody["value"] = map[string]interface{}{"name": "John", "age": 30}
+	invalidBody := map[string]interface{}{}
+	invalidBody["key"] = "user:2"
+	invalidBody["value"] = map[string]interface{}{"age": -1.5, "extra": true}
+	removeBody := map[string]interface{}{}
+	removeBody["prefix"] = "user:"
+	requests := []testRequest{
+		{
+			url:    server.URL + adminPath + "/schemas/",
+			method: http.MethodPost,
+			body:   schemaBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/dict/",
+			method: http.MethodPost,
+			body:   validBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath,
+			method: http.MethodPost,
+			body:   invalidBody,
+			response: testResponse{
+				responseCode: http.StatusUnprocessableEntity,
+				response: Resp{
+					Response: []interface{}{
+						map[string]interface{}{"path": "$", "message": "property name is required"},
+						map[string]interface{}{"path": "$.age", "message": "expected type integer, got number"},
+						map[string]interface{}{"path": "$.extra", "message": "additional property is not allowed"},
+					},
+					Error: ValidationFailed.String(),
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:         server.URL + urlPath + "/doc/user:1",
+			method:      http.MethodPatch,
+			rawBody:     map[string]interface{}{"name": nil},
+			contentType: contentTypeMergePatch,
+			response: testResponse{
+				responseCode: http.StatusUnprocessableEntity,
+				response: Resp{
+					Response: []interface{}{
+						map[string]interface{}{"path": "$", "message": "property name is required"},
+					},
+					Error: ValidationFailed.String(),
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:         server.URL + urlPath + "/doc/user:1",
+			method:      http.MethodPatch,
+			rawBody:     []map[string]interface{}{{"op": "add", "path": "/extra", "value": 1}},
+			contentType: contentTypeJSONPatch,
+			response: testResponse{
+				responseCode: http.StatusUnprocessableEntity,
+				response: Resp{
+					Response: []interface{}{
+						map[string]interface{}{"path": "$.extra", "message": "additional property is not allowed"},
+					},
+					Error: ValidationFailed.String(),
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + adminPath + "/schemas/",
+			method: http.MethodDelete,
+			body:   removeBody,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath,
+			method: http.MethodPost,
+			body:   invalidBody,
 			response: testResponse{
 				responseCode: http.StatusOK,
 				response: Resp{
-					Response: nestedList[1],
+					Response: "",
 					Ok:       true,
 				},
 			},
 		},
+	}
+	testRequests(t, requests)
+	require.Empty(t, mockStorage.schemas)
+	value, _ := getStorage().Get("user:1")
+	require.Equal(t, map[string]interface{}{"name": "John", "age": json.Number("30")}, value)
+
+	resp, err := http.Post(server.URL+adminPath+"/import?mode=merge", "application/x-ndjson",
+		strings.NewReader(`{"key":"user:3","type":"dict","value":{"name":"Ann"}}`+"\n"+`{"key":"user:4","type":"dict","value":{"age":1}}`+"\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, schemas.Set("user:", map[string]interface{}{"required": []interface{}{"name"}}))
+	resp, err = http.Post(server.URL+adminPath+"/import?mode=merge", "application/x-ndjson",
+		strings.NewReader(`{"key":"user:5","type":"dict","value":{"name":"Ann"}}`+"\n"+`{"key":"user:6","type":"dict","value":{"age":1}}`+"\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	// Merge applies records as they are read
+	_, ok := getStorage().Get("user:5")
+	require.True(t, ok)
+	_, ok = getStorage().Get("user:6")
+	require.False(t, ok)
+	// Replace is applied as a whole
+	resp, err = http.Post(server.URL+adminPath+"/import?mode=replace&prefix=user:7", "application/x-ndjson",
+		strings.NewReader(`{"key":"user:7a","type":"dict","value":{"name":"Ann"}}`+"\n"+`{"key":"user:7b","type":"dict","value":{"age":1}}`+"\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	_, ok = getStorage().Get("user:7a")
+	require.False(t, ok)
+	schemas.Remove("user:")
+}
+
+func TestSchemaNotSaved(t *testing.T) {
+	mockStorage.schemasErr = PersistUnhealthy
+	defer func() { mockStorage.schemasErr = nil }()
+	schemaBody := map[string]interface{}{}
+	schemaBody["prefix"] = "unsaved:"
+	schemaBody["schema"] = map[string]interface{}{"type": "string"}
+	valueBody := map[string]interface{}{}
+	valueBody["key"] = "unsaved:1"
+	valueBody["value"] = 1
+	requests := []testRequest{
 		{
-			url:    server.URL + urlPath + "/getlist/absentlist/0",
-			method: http.MethodGet,
+			url:    server.URL + adminPath + "/schemas/",
+			method: http.MethodPost,
+			body:   schemaBody,
 			response: testResponse{
-				responseCode: http.StatusNotFound,
+				responseCode: http.StatusInternalServerError,
 				response: Resp{
-					Error: KeyNotFound.String(),
+					Error: PersistUnhealthy.String(),
 					Ok:    false,
 				},
 			},
 		},
 		{
-			url:    server.URL + urlPath + "/getlist/list/100",
-			method: http.MethodGet,
+			url:    server.URL + urlPath,
+			method: http.MethodPost,
+			body:   valueBody,
 			response: testResponse{
-				responseCode: http.StatusNotFound,
+				responseCode: http.StatusOK,
 				response: Resp{
-					Error: "Out of bound",
-					Ok:    false,
+					Response: "",
+					Ok:       true,
 				},
 			},
 		},
 	}
 	testRequests(t, requests)
-	value, ok := storage.Get("list")
-	require.True(t, ok)
-	require.Equal(t, postBody["value"], value)
+	_, ok := schemas.Match("unsaved:1")
+	require.False(t, ok)
 }
 
 func TestUpdateRecord(t *testing.T) {
@@ -258,9 +1012,9 @@ func TestUpdateRecord(t *testing.T) {
 		},
 	}
 	testRequests(t, requests)
-	value, ok := storage.Get(postBodyt2["key"].(string))
+	value, ok := getStorage().Get(postBodyt2["key"].(string))
 	require.True(t, ok)
-	require.Equal(t, postBodyt2["value"], value)
+	requireSameJSON(t, postBodyt2["value"], value)
 
 }
 
@@ -309,7 +1063,7 @@ func TestRemoveRecord(t *testing.T) {
 		},
 	}
 	testRequests(t, requests)
-	_, ok := storage.Get(postBodyt2["key"].(string))
+	_, ok := getStorage().Get(postBodyt2["key"].(string))
 	require.False(t, ok)
 
 }
@@ -362,6 +1116,171 @@ func TestPersist(t *testing.T) {
 
 }
 
+func TestAutosave(t *testing.T) {
+	mockStorage.On("SaveToDb").Return(nil)
+	StartAutosave(0, 2, false)
+	defer StopAutosave()
+	runs := snapshots.getStatus().Runs
+	postBody := map[string]interface{}{}
+	postBody["key"] = "autosave"
+	postBody["value"] = "v1"
+	request := testRequest{
+		url:    server.URL + urlPath,
+		method: http.MethodPost,
+		body:   postBody,
+		response: testResponse{
+			responseCode: http.StatusOK,
+			response: Resp{
+				Response: "",
+				Ok:       true,
+			},
+		},
+	}
+	testRequests(t, []testRequest{request, request})
+	for i := 0; i < 100 && snapshots.getStatus().Runs == runs; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := snapshots.getStatus()
+	require.Equal(t, runs+1, status.Runs)
+	require.Equal(t, int64(0), status.WritesSinceSave)
+	require.False(t, status.LastSuccess.IsZero())
+}
+
+func TestReady(t *testing.T) {
+	SetReady(false)
+	requests := []testRequest{
+		{
+			url:    server.URL + "/v1/ready",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusServiceUnavailable,
+				response: Resp{
+					Error: NotReady.String(),
+					Ok:    false,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/get/t1",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusServiceUnavailable,
+				response: Resp{
+					Error: NotReady.String(),
+					Ok:    false,
+				},
+			},
+		},
+	}
+	for _, path := range []string{"/jobs/save", "/jobs/load", "/jobs/reencrypt", "/snapshots/1/restore", "/import", "/schemas/"} {
+		requests = append(requests, testRequest{
+			url:    server.URL + adminPath + path,
+			method: http.MethodPost,
+			body:   map[string]interface{}{},
+			response: testResponse{
+				responseCode: http.StatusServiceUnavailable,
+				response: Resp{
+					Error: NotReady.String(),
+					Ok:    false,
+				},
+			},
+		})
+	}
+	testRequests(t, requests)
+	mockStorage.On("LoadFromDb").Return(nil)
+	// Load on start doesn't run together with other load
+	atomic.StoreInt32(&loading, 1)
+	require.Equal(t, LoadInProgress, LoadOnStart())
+	atomic.StoreInt32(&loading, 0)
+	require.False(t, IsReady())
+	require.NoError(t, LoadOnStart())
+	testRequests(t, []testRequest{
+		{
+			url:    server.URL + "/v1/ready",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "ready",
+					Ok:       true,
+				},
+			},
+		},
+	})
+}
+
+type brokenStorage struct {
+	*MockPersistStorage
+}
+
+func (t brokenStorage) LoadFromDb(storage *kvstorage.Storage) error {
+	storage.Set("partial", "value", 0)
+	return PersistUnhealthy
+}
+
+func TestLoadOnStartFailure(t *testing.T) {
+	InitPersistentStorage(brokenStorage{mockStorage})
+	defer InitPersistentStorage(mockStorage)
+	getStorage().Set("current", "value", 0)
+	defer getStorage().Remove("current")
+	previous := getStorage()
+	require.Equal(t, PersistUnhealthy, LoadOnStart())
+	// Partially loaded data doesn't replace current one
+	require.True(t, previous == getStorage())
+	_, ok := getStorage().Get("partial")
+	require.False(t, ok)
+	require.True(t, snapshots.getStatus().Suspended)
+
+	// Autosave doesn't overwrite persistent data until it is saved explicitly
+	mockStorage.On("SaveToDb").Return(nil)
+	StartAutosave(0, 1, false)
+	defer StopAutosave()
+	runs := snapshots.getStatus().Runs
+	snapshots.registerWrite()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, runs, snapshots.getStatus().Runs)
+	require.NoError(t, snapshots.save(false))
+	require.False(t, snapshots.getStatus().Suspended)
+}
+
+func TestIncrementalSave(t *testing.T) {
+	// Changed keys are not collected until somebody takes them
+	require.False(t, getStorage().IsDirtyTracked())
+	getStorage().Set("dirty0", "v0", 0)
+	require.Equal(t, 0, getStorage().DirtyCount())
+	StartAutosave(0, 0, true)
+	require.True(t, getStorage().IsDirtyTracked())
+
+	getStorage().Set("dirty1", "v1", 0)
+	getStorage().Set("dirty2", "v2", 0)
+	getStorage().Remove("dirty2")
+	changed, deleted := getStorage().TakeDirty()
+	require.Equal(t, []string{"dirty1"}, changed)
+	require.Equal(t, []string{"dirty2"}, deleted)
+	getStorage().Set("dirty1", "v2", 0)
+	getStorage().RestoreDirty(changed, deleted)
+	require.Equal(t, 2, getStorage().DirtyCount())
+
+	mockStorage.On("SaveChangesToDb").Return(nil)
+	testRequests(t, []testRequest{
+		{
+			url:    server.URL + urlPath + "/saveToDb?mode=incremental",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+	})
+	mockStorage.AssertCalled(t, "SaveChangesToDb")
+	require.Equal(t, 0, getStorage().DirtyCount())
+	StopAutosave()
+	require.False(t, getStorage().IsDirtyTracked())
+}
+
 func TestAddRecord(t *testing.T) {
 	postBodyt1 := map[string]interface{}{}
 	postBodyt1["key"] = "t1"
@@ -459,15 +1378,21 @@ func TestAddRecord(t *testing.T) {
 		},
 	}
 	testRequests(t, requests)
-	value, ok := storage.Get(postBodyt1["key"].(string))
+	value, ok := getStorage().Get(postBodyt1["key"].(string))
 	require.True(t, ok)
-	require.Equal(t, postBodyt1["value"], value)
-	value, ok = storage.Get(postBodyt2["key"].(string))
+	requireSameJSON(t, postBodyt1["value"], value)
+	value, ok = getStorage().Get(postBodyt2["key"].(string))
 	require.True(t, ok)
-	require.Equal(t, postBodyt2["value"], value)
-	value, ok = storage.Get(postBodyt3["key"].(string))
+	requireSameJSON(t, postBodyt2["value"], value)
+	value, ok = getStorage().Get(postBodyt3["key"].(string))
 	require.True(t, ok)
-	require.Equal(t, postBodyt3["value"], value)
+	requireSameJSON(t, postBodyt3["value"], value)
+
+	// Integers are kept exactly, even if float64 can't represent them
+	resp, err := http.Post(server.URL+urlPath, "application/json", strings.NewReader(`{"key":"big","value":9007199254740993}`))
+	checkRequest(t, testRequest{response: testResponse{responseCode: http.StatusOK, response: Resp{Response: "", Ok: true}}}, resp, err)
+	value, _ = getStorage().Get("big")
+	require.Equal(t, json.Number("9007199254740993"), value)
 }
 
 func TestKeys(t *testing.T) {
@@ -518,12 +1443,12 @@ func TestKeys(t *testing.T) {
 		},
 	}
 	testRequests(t, requests)
-	value, ok := storage.Get(postBodyt1["key"].(string))
+	value, ok := getStorage().Get(postBodyt1["key"].(string))
 	require.True(t, ok)
-	require.Equal(t, postBodyt1["value"], value)
-	value, ok = storage.Get(postBodyt2["key"].(string))
+	requireSameJSON(t, postBodyt1["value"], value)
+	value, ok = getStorage().Get(postBodyt2["key"].(string))
 	require.True(t, ok)
-	require.Equal(t, postBodyt2["value"], value)
+	requireSameJSON(t, postBodyt2["value"], value)
 }
 
 func BenchmarkTotal(b *testing.B) {
@@ -603,3 +1528,471 @@ func init() {
 	}
 	log.SetOutput(filter)
 }
+
+func TestPersistMode(t *testing.T) {
+	require.Error(t, StartPersistMode("unknown", 10, 2, time.Hour))
+
+	mockStorage.On("SaveKeys", []string{"wt1"}).Return(nil)
+	require.NoError(t, StartPersistMode(PERSIST_MODE_WRITE_THROUGH, 10, 2, time.Hour))
+	testRequests(t, []testRequest{
+		{
+			url:    server.URL + urlPath,
+			method: http.MethodPost,
+			body:   map[string]interface{}{"key": "wt1", "value": "v1"},
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "",
+					Ok:       true,
+				},
+			},
+		},
+	})
+	mockStorage.AssertCalled(t, "SaveKeys", []string{"wt1"})
+	// Client gets error if changed key can't be written
+	mockStorage.On("SaveKeys", []string{"wt2"}).Return(PersistUnhealthy).Once()
+	testRequests(t, []testRequest{
+		{
+			url:    server.URL + urlPath,
+			method: http.MethodPost,
+			body:   map[string]interface{}{"key": "wt2", "value": "v2"},
+			response: testResponse{
+				responseCode: http.StatusInternalServerError,
+				response: Resp{
+					Error: PersistUnhealthy.String(),
+					Ok:    false,
+				},
+			},
+		},
+	})
+	require.Equal(t, 1, writes.getStatus().Queued)
+	mockStorage.On("SaveKeys", []string{"wt2"}).Return(nil)
+	require.NoError(t, writes.sync())
+	require.Equal(t, 0, writes.getStatus().Queued)
+	StopPersistMode()
+
+	mockStorage.On("SaveKeys", mock.Anything).Return(nil)
+	require.NoError(t, StartPersistMode(PERSIST_MODE_WRITE_BEHIND, 10, 2, time.Hour))
+	getStorage().Set("wb1", "v1", 0)
+	getStorage().Set("wb2", "v2", 0)
+	// First batch is written before stop, so the rest is written on drain
+	require.NoError(t, writes.sync())
+	require.Equal(t, int64(2), writes.getStatus().Written)
+	getStorage().Set("wb3", "v3", 0)
+	StopPersistMode()
+	mockStorage.AssertCalled(t, "SaveKeys", []string{"wb1", "wb2"})
+	mockStorage.AssertCalled(t, "SaveKeys", []string{"wb3"})
+	status := writes.getStatus()
+	require.Equal(t, PERSIST_MODE_SNAPSHOT, status.Mode)
+	require.Equal(t, int64(3), status.Written)
+	require.Equal(t, 0, status.Queued)
+	getStorage().Set("wb4", "v4", 0)
+	mockStorage.AssertNotCalled(t, "SaveKeys", []string{"wb4"})
+}
+
+func TestReadThrough(t *testing.T) {
+	mockStorage.On("LoadKey", "rt1").After(50*time.Millisecond).Return("v1", int64(0), true, nil)
+	mockStorage.On("LoadKey", "rt2").Return(nil, int64(0), false, nil)
+	require.NoError(t, StartReadThrough(time.Minute))
+	defer StopReadThrough()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, ok := getStorage().Get("rt1")
+			require.True(t, ok)
+			require.Equal(t, "v1", value)
+		}()
+	}
+	wg.Wait()
+	mockStorage.AssertNumberOfCalls(t, "LoadKey", 1)
+	testRequests(t, []testRequest{
+		{
+			url:    server.URL + urlPath + "/get/rt1",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusOK,
+				response: Resp{
+					Response: "v1",
+					Ok:       true,
+				},
+			},
+		},
+		{
+			url:    server.URL + urlPath + "/get/rt2",
+			method: http.MethodGet,
+			response: testResponse{
+				responseCode: http.StatusNotFound,
+				response: Resp{
+					Response: nil,
+					Ok:       false,
+					Error:    KeyNotFound.String(),
+				},
+			},
+		},
+	})
+	mockStorage.AssertNumberOfCalls(t, "LoadKey", 2)
+	// Cached values are not written back
+	changed, _ := getStorage().TakeDirty()
+	require.NotContains(t, changed, "rt1")
+
+	// Changed values are loaded first and then expire like the source instead of the cache
+	expiration := time.Now().Add(time.Hour).Unix()
+	geoSet := kvstorage.NewGeoSet()
+	geoSet.Add(kvstorage.GeoMember{Name: "Rome", Longitude: 12.5, Latitude: 41.9})
+	mockStorage.On("LoadKey", "rt3").Return(map[string]interface{}{"a": 1.0}, expiration, true, nil)
+	mockStorage.On("LoadKey", "rt4").Return([]byte{0x80}, int64(0), true, nil)
+	mockStorage.On("LoadKey", "rt5").Return(geoSet, expiration, true, nil)
+	require.NoError(t, getStorage().MergePatch("rt3", map[string]interface{}{"b": 2.0}))
+	value, ttl, ok := getStorage().GetWithTTL("rt3")
+	require.True(t, ok)
+	require.Equal(t, map[string]interface{}{"a": 1.0, "b": 2.0}, value)
+	require.Equal(t, expiration, ttl)
+	_, err := getStorage().SetBit("rt4", 1, 1)
+	require.NoError(t, err)
+	value, ttl, _ = getStorage().GetWithTTL("rt4")
+	require.Equal(t, []byte{0xc0}, value)
+	require.Equal(t, int64(0), ttl)
+	_, err = getStorage().GeoAdd("rt5", []kvstorage.GeoMember{{Name: "Oslo", Longitude: 10.7, Latitude: 59.9}}, 0)
+	require.NoError(t, err)
+	_, ttl, _ = getStorage().GetWithTTL("rt5")
+	require.Equal(t, expiration, ttl)
+	changed, _ = getStorage().TakeDirty()
+	for _, key := range []string{"rt3", "rt4", "rt5"} {
+		require.Contains(t, changed, key)
+	}
+
+	// Keys set or deleted while they are loaded keep the change
+	mockStorage.On("LoadKey", "rt6").After(100*time.Millisecond).Return("source", int64(0), true, nil)
+	mockStorage.On("LoadKey", "rt7").After(100*time.Millisecond).Return("source", int64(0), true, nil)
+	for _, key := range []string{"rt6", "rt7"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			getStorage().Get(key)
+		}(key)
+	}
+	time.Sleep(30 * time.Millisecond)
+	getStorage().Set("rt6", "written", 0)
+	require.NoError(t, getStorage().Remove("rt7"))
+	wg.Wait()
+	value, _ = getStorage().Get("rt6")
+	require.Equal(t, "written", value)
+	_, ok = getStorage().Get("rt7")
+	require.False(t, ok)
+	_, deleted := getStorage().TakeDirty()
+	require.Equal(t, []string{"rt7"}, deleted)
+	mockStorage.AssertNumberOfCalls(t, "LoadKey", 7)
+}
+
+func TestLoadModes(t *testing.T) {
+	mockStorage.On("LoadFromDb").Return(nil)
+	mockStorage.data = map[string]interface{}{"lm:a": "db", "lm:b": "db", "other": "db"}
+	defer func() { mockStorage.data = nil }()
+	getStorage().Set("lm:a", "memory", 0)
+	getStorage().Set("lm:c", "memory", 0)
+	getStorage().Set("keep", "memory", 0)
+	load := func(query string, code int) {
+		res := Resp{Response: "", Ok: true}
+		if code == http.StatusBadRequest {
+			res = Resp{Ok: false, Error: UnknownLoadMode.String()}
+		}
+		testRequests(t, []testRequest{
+			{
+				url:    server.URL + urlPath + "/loadFromDb?" + query,
+				method: http.MethodGet,
+				response: testResponse{
+					responseCode: code,
+					response:     res,
+				},
+			},
+		})
+	}
+	check := func(expected map[string]interface{}) {
+		for key, value := range expected {
+			actual, _ := getStorage().Get(key)
+			require.Equal(t, value, actual, key)
+		}
+	}
+
+	load("mode=unknown", http.StatusBadRequest)
+	load("mode=merge-keep&prefix=lm:", http.StatusOK)
+	check(map[string]interface{}{"lm:a": "memory", "lm:b": "db", "lm:c": "memory", "keep": "memory", "other": nil})
+	load("mode=merge&prefix=lm:", http.StatusOK)
+	check(map[string]interface{}{"lm:a": "db", "lm:b": "db", "lm:c": "memory", "keep": "memory", "other": nil})
+	load("mode=replace&prefix=lm:", http.StatusOK)
+	check(map[string]interface{}{"lm:a": "db", "lm:b": "db", "lm:c": nil, "keep": "memory", "other": nil})
+	previous := getStorage()
+	load("", http.StatusOK)
+	require.False(t, previous == getStorage())
+	check(map[string]interface{}{"lm:a": "db", "lm:b": "db", "lm:c": nil, "keep": nil, "other": "db"})
+	require.Equal(t, 0, getStorage().DirtyCount())
+
+	// Keys written to current storage while it is being replaced are kept
+	mockStorage.onLoad = func() {
+		testRequests(t, []testRequest{
+			{
+				url:      server.URL + urlPath,
+				method:   http.MethodPost,
+				body:     map[string]interface{}{"key": "lm:written", "value": "memory"},
+				response: testResponse{responseCode: http.StatusOK, response: Resp{Response: "", Ok: true}},
+			},
+		})
+		getStorage().Remove("lm:b")
+	}
+	defer func() { mockStorage.onLoad = nil }()
+	load("", http.StatusOK)
+	check(map[string]interface{}{"lm:a": "db", "lm:b": nil, "lm:written": "memory", "other": "db"})
+}
+
+func TestJobs(t *testing.T) {
+	mockStorage.On("SaveToDb").Return(nil)
+	request := func(method, url string, code int) jobStatus {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, code, resp.StatusCode)
+		var res struct {
+			Response jobStatus `json:"response"`
+			Ok       bool      `json:"ok"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		require.Equal(t, code < 300, res.Ok)
+		return res.Response
+	}
+	status := request(http.MethodPost, server.URL+adminPath+"/jobs/save", http.StatusAccepted)
+	require.Equal(t, JOB_TYPE_SAVE, status.Type)
+	require.NotEmpty(t, status.ID)
+	for i := 0; i < 100 && status.State == JOB_STATE_RUNNING; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = request(http.MethodGet, server.URL+adminPath+"/jobs/"+status.ID, http.StatusOK)
+	}
+	require.Equal(t, JOB_STATE_DONE, status.State)
+	require.False(t, status.Finished.IsZero())
+	status = request(http.MethodDelete, server.URL+adminPath+"/jobs/"+status.ID, http.StatusOK)
+	require.Equal(t, JOB_STATE_DONE, status.State)
+	request(http.MethodGet, server.URL+adminPath+"/jobs/unknown", http.StatusNotFound)
+	request(http.MethodPost, server.URL+adminPath+"/jobs/load?mode=unknown", http.StatusBadRequest)
+
+	status = jobs.start(JOB_TYPE_LOAD, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	request(http.MethodDelete, server.URL+adminPath+"/jobs/"+status.ID, http.StatusOK)
+	StopJobs()
+	status, _ = jobs.get(status.ID)
+	require.Equal(t, JOB_STATE_CANCELLED, status.State)
+}
+
+func TestExportImport(t *testing.T) {
+	getStorage().Set("ei:a", "v1", 0)
+	getStorage().Set("ei:b", []interface{}{1.0, "two"}, time.Hour)
+	resp, err := http.Get(server.URL + adminPath + "/export?prefix=ei:")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	exported, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(exported, []byte("\n")))
+
+	getStorage().Remove("ei:a")
+	getStorage().Set("ei:b", "changed", 0)
+	getStorage().Set("ei:c", "kept", 0)
+	resp, err = http.Post(server.URL+adminPath+"/import?mode=merge-keep", "application/x-ndjson", bytes.NewReader(exported))
+	require.NoError(t, err)
+	// Only absent key is applied
+	checkRequest(t, testRequest{response: testResponse{responseCode: http.StatusOK, response: Resp{Response: 1.0, Ok: true}}}, resp, err)
+	value, _ := getStorage().Get("ei:a")
+	require.Equal(t, "v1", value)
+	value, _ = getStorage().Get("ei:b")
+	require.Equal(t, "changed", value)
+
+	resp, err = http.Post(server.URL+adminPath+"/import?prefix=ei:&mode=replace", "application/x-ndjson", bytes.NewReader(exported))
+	checkRequest(t, testRequest{response: testResponse{responseCode: http.StatusOK, response: Resp{Response: 2.0, Ok: true}}}, resp, err)
+	value, ttl, _ := getStorage().GetWithTTL("ei:b")
+	require.Equal(t, []interface{}{json.Number("1"), "two"}, value)
+	require.True(t, ttl > time.Now().Unix())
+	_, ok := getStorage().Get("ei:c")
+	require.False(t, ok)
+
+	resp, err = http.Post(server.URL+adminPath+"/import", "application/x-ndjson", strings.NewReader("{broken"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Post(server.URL+adminPath+"/import?mode=unknown", "application/x-ndjson", bytes.NewReader(exported))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// unhealthyStorage is persistent storage which reports lost connection
+type unhealthyStorage struct {
+	*MockPersistStorage
+}
+
+func (t unhealthyStorage) Health() persist.Health {
+	return persist.Health{Healthy: false, LastError: "no reachable servers", Failures: 1}
+}
+
+func TestPersistHealth(t *testing.T) {
+	resp, err := http.Get(server.URL + adminPath + "/persist/health")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	InitPersistentStorage(unhealthyStorage{mockStorage})
+	defer InitPersistentStorage(mockStorage)
+	resp, err = http.Get(server.URL + adminPath + "/persist/health")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	var res struct {
+		Response persist.Health `json:"response"`
+		Error    string         `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Equal(t, PersistUnhealthy.String(), res.Error)
+	require.Equal(t, "no reachable servers", res.Response.LastError)
+}
+
+func TestReencryptJob(t *testing.T) {
+	resp, err := http.Post(server.URL+adminPath+"/jobs/reencrypt", "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var res Resp
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Equal(t, EncryptionNotConfigured.String(), res.Error)
+}
+
+func TestCompression(t *testing.T) {
+	require.NoError(t, StartCompression(64, -1))
+	defer StopCompression()
+	document := map[string]interface{}{
+		"text":  strings.Repeat("compressible ", 20),
+		"list":  []interface{}{},
+		"n":     int64(1) << 60,
+		"items": []interface{}{1.5, nil, true, map[string]interface{}{}},
+	}
+	getStorage().Set("compressed", document, 0)
+	getStorage().Set("compressedText", strings.Repeat("a", 100), 0)
+	getStorage().Set("smallText", "a", 0)
+	value, ok := getStorage().Get("compressed")
+	require.True(t, ok)
+	require.Equal(t, document, value)
+	value, ok = getStorage().Get("compressedText")
+	require.True(t, ok)
+	require.Equal(t, strings.Repeat("a", 100), value)
+	require.NoError(t, getStorage().MergePatch("compressed", map[string]interface{}{"text": "short"}))
+	value, _ = getStorage().Get("compressed")
+	require.Equal(t, "short", value.(map[string]interface{})["text"])
+
+	resp, err := http.Get(server.URL + urlPath + "/get/compressed")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Contains(t, string(body), `"list":[]`)
+
+	resp, err = http.Get(server.URL + adminPath + "/compression")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var res struct {
+		Response compressionStats `json:"response"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Nil(t, res.Response.Persist)
+	require.NotNil(t, res.Response.Memory)
+	require.True(t, res.Response.Memory.Values >= 2)
+	require.True(t, res.Response.Memory.Ratio > 1)
+	require.True(t, res.Response.Memory.Decompressions >= 3)
+}
+
+// generationStorage is persistent storage which keeps generations in memory
+type generationStorage struct {
+	*MockPersistStorage
+	generations map[string]map[string]interface{}
+}
+
+func (t generationStorage) Generations() ([]persist.Generation, error) {
+	res := []persist.Generation{}
+	for id, data := range t.generations {
+		res = append(res, persist.Generation{ID: id, Keys: int64(len(data))})
+	}
+	return res, nil
+}
+
+func (t generationStorage) RestoreGeneration(ctx context.Context, id string, storage *kvstorage.Storage) error {
+	for key, value := range t.generations[id] {
+		storage.Set(key, value, 0)
+	}
+	return nil
+}
+
+func TestSnapshotGenerations(t *testing.T) {
+	request := func(method, url string, code int) Resp {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, code, resp.StatusCode)
+		var res Resp
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return res
+	}
+	res := request(http.MethodGet, server.URL+adminPath+"/snapshots", http.StatusBadRequest)
+	require.Equal(t, GenerationsNotSupported.String(), res.Error)
+
+	InitPersistentStorage(generationStorage{mockStorage, map[string]map[string]interface{}{
+		"20261019T120000.000Z": {"gen:a": "old", "gen:b": "old"},
+	}})
+	defer InitPersistentStorage(mockStorage)
+	res = request(http.MethodGet, server.URL+adminPath+"/snapshots", http.StatusOK)
+	require.Equal(t, []interface{}{map[string]interface{}{"id": "20261019T120000.000Z", "created": "0001-01-01T00:00:00Z", "keys": 2.0}}, res.Response)
+	res = request(http.MethodPost, server.URL+adminPath+"/snapshots/unknown/restore", http.StatusNotFound)
+	require.Equal(t, GenerationNotFound.String(), res.Error)
+	request(http.MethodPost, server.URL+adminPath+"/snapshots/20261019T120000.000Z/restore?mode=unknown", http.StatusBadRequest)
+
+	getStorage().Set("gen:a", "new", 0)
+	getStorage().Set("gen:c", "new", 0)
+	res = request(http.MethodPost, server.URL+adminPath+"/snapshots/20261019T120000.000Z/restore?prefix=gen:", http.StatusAccepted)
+	id := res.Response.(map[string]interface{})["id"].(string)
+	status, _ := jobs.get(id)
+	for i := 0; i < 100 && status.State == JOB_STATE_RUNNING; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, _ = jobs.get(id)
+	}
+	require.Equal(t, JOB_STATE_DONE, status.State)
+	require.Equal(t, JOB_TYPE_RESTORE, status.Type)
+	value, _ := getStorage().Get("gen:a")
+	require.Equal(t, "old", value)
+	value, _ = getStorage().Get("gen:b")
+	require.Equal(t, "old", value)
+	_, ok := getStorage().Get("gen:c")
+	require.False(t, ok)
+}
+
+func TestMemoryPersistStorage(t *testing.T) {
+	memoryStorage, err := persist.OpenURL("memory://", persist.BackendOptions{})
+	require.NoError(t, err)
+	InitPersistentStorage(memoryStorage)
+	defer InitPersistentStorage(mockStorage)
+	getStorage().Set("memory", []interface{}{"saved"}, 0)
+	resp, err := http.Get(server.URL + urlPath + "/saveToDb")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	getStorage().Set("memory", "changed", 0)
+	resp, err = http.Get(server.URL + urlPath + "/loadFromDb?prefix=memory")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	value, _ := getStorage().Get("memory")
+	require.Equal(t, []interface{}{"saved"}, value)
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const AUTOSAVE_GOROUTINE_NAME = "autosave"
+
+// autosaveStatus is state of snapshots to persistent storage
+type autosaveStatus struct {
+	Running         bool      `json:"running"`
+	Incremental     bool      `json:"incremental"`
+	Interval        string    `json:"interval"`
+	WritesThreshold int64     `json:"writesThreshold"`
+	WritesSinceSave int64     `json:"writesSinceSave"`
+	Runs            int64     `json:"runs"`
+	Failures        int64     `json:"failures"`
+	LastSuccess     time.Time `json:"lastSuccess"`
+	LastDuration    string    `json:"lastDuration"`
+	LastError       string    `json:"lastError"`
+	LastErrorTime   time.Time `json:"lastErrorTime"`
+	// Suspended is true after failed load on start until data is loaded or saved explicitly
+	Suspended bool `json:"suspended"`
+}
+
+// autosave runs snapshots on interval and after number of writes. Only one snapshot runs at a time
+type autosave struct {
+	sync.Mutex
+	status  autosaveStatus
+	running int32
+	writes  int64
+	trigger chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+var snapshots = &autosave{}
+
+// statusWriter remembers response status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (t *statusWriter) WriteHeader(status int) {
+	t.status = status
+	t.ResponseWriter.WriteHeader(status)
+}
+
+// StartAutosave starts saving storage to persistent storage every interval and after writesThreshold writes.
+// Zero value disables corresponding trigger. Incremental autosave writes only keys changed since previous save
+func StartAutosave(interval time.Duration, writesThreshold int64, incremental bool) {
+	snapshots.Lock()
+	snapshots.status.Incremental = incremental
+	snapshots.status.Interval = interval.String()
+	snapshots.status.WritesThreshold = writesThreshold
+	snapshots.trigger = make(chan struct{}, 1)
+	snapshots.done = make(chan struct{})
+	snapshots.Unlock()
+	trackChanges(getStorage())
+	snapshots.wg.Add(1)
+	go snapshots.loop(interval)
+	log.Println(logs.MakeLogString(logs.INFO, AUTOSAVE_GOROUTINE_NAME, "Autosave started with interval "+interval.String(), nil))
+}
+
+// StopAutosave stops background snapshots and waits for running one
+func StopAutosave() {
+	snapshots.Lock()
+	done := snapshots.done
+	snapshots.done = nil
+	snapshots.Unlock()
+	if done == nil {
+		return
+	}
+	close(done)
+	snapshots.wg.Wait()
+	trackChanges(getStorage())
+}
+
+// isIncremental reports whether autosave is running and writes only changed keys
+func (t *autosave) isIncremental() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.done != nil && t.status.Incremental
+}
+
+// trackChanges makes storage remember changed keys only while somebody takes them: incremental autosave
+// or any save in read-through mode. Otherwise changed keys would be collected without bound
+func trackChanges(storage *kvstorage.Storage) {
+	if storage == nil {
+		return
+	}
+	storage.TrackDirty(snapshots.isIncremental() || cache.isEnabled())
+}
+
+// loop waits for interval or writes trigger and saves storage
+func (t *autosave) loop(interval time.Duration) {
+	defer t.wg.Done()
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	t.Lock()
+	done := t.done
+	trigger := t.trigger
+	incremental := t.status.Incremental
+	t.Unlock()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+		case <-trigger:
+		}
+		if !IsReady() || isPersistedHeld() {
+			continue
+		}
+		if err := t.save(incremental); err != nil && err != SaveInProgress {
+			log.Println(logs.MakeLogString(logs.ERROR, AUTOSAVE_GOROUTINE_NAME, "Autosave failed", err))
+		}
+	}
+}
+
+// save stores all data (or only changes if incremental) to persistent storage unless another save is running
+func (t *autosave) save(incremental bool) error {
+	return t.saveContext(context.Background(), incremental)
+}
+
+// saveContext is save which can be cancelled
+func (t *autosave) saveContext(ctx context.Context, incremental bool) error {
+	if !atomic.CompareAndSwapInt32(&t.running, 0, 1) {
+		return SaveInProgress
+	}
+	defer atomic.StoreInt32(&t.running, 0)
+	writes := atomic.SwapInt64(&t.writes, 0)
+	start := time.Now()
+	var err error
+	// Only part of records is in memory in read-through mode, so full save would remove the rest
+	err = persistSave(ctx, incremental || cache.isEnabled())
+	t.Lock()
+	defer t.Unlock()
+	t.status.Runs++
+	if err != nil {
+		atomic.AddInt64(&t.writes, writes)
+		t.status.Failures++
+		t.status.LastError = err.Error()
+		t.status.LastErrorTime = time.Now()
+		return err
+	}
+	// Autosave doesn't run while persistent data is held, so it is saved explicitly
+	if isPersistedHeld() {
+		holdPersisted(false)
+	}
+	t.status.LastSuccess = time.Now()
+	t.status.LastDuration = time.Since(start).String()
+	log.Println(logs.MakeLogString(logs.DEBUG, AUTOSAVE_GOROUTINE_NAME, "Saved storage in "+t.status.LastDuration, nil))
+	return nil
+}
+
+// registerWrite counts write and triggers save when threshold is reached
+func (t *autosave) registerWrite() {
+	writes := atomic.AddInt64(&t.writes, 1)
+	t.Lock()
+	threshold := t.status.WritesThreshold
+	trigger := t.trigger
+	t.Unlock()
+	if threshold > 0 && writes >= threshold && trigger != nil {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// getStatus returns copy of current status
+func (t *autosave) getStatus() autosaveStatus {
+	t.Lock()
+	defer t.Unlock()
+	status := t.status
+	status.Running = atomic.LoadInt32(&t.running) == 1
+	status.WritesSinceSave = atomic.LoadInt64(&t.writes)
+	status.Suspended = isPersistedHeld()
+	return status
+}
+
+// countWrites is middleware which counts successful modifying requests for autosave
+func countWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status < http.StatusBadRequest {
+			snapshots.registerWrite()
+		}
+	})
+}
+
+// getAutosaveStatus returns last snapshot time, errors and writes since last snapshot
+func getAutosaveStatus(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, Resp{Response: snapshots.getStatus(), Ok: true})
+}
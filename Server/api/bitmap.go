@@ -0,0 +1,218 @@
+package api
+
+import (
+	"encoding/base64"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/pressly/chi"
+	"github.com/pressly/chi/render"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const contentTypeOctetStream = "application/octet-stream"
+
+// addBitmap puts binary value to storage. Value may be sent as base64 string in JSON
+// or as raw body with 'application/octet-stream' content type (key is taken from URL then)
+func addBitmap(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		TTL   int64  `json:"ttl"`
+	}
+	var value []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeOctetStream) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			render.Status(r, http.StatusNotAcceptable)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+		data.Key = chi.URLParam(r, "key")
+		data.TTL, _ = strconv.ParseInt(r.URL.Query().Get("ttl"), 10, 64)
+		value = body
+	} else {
+		if err := bindJSON(r.Body, &data); err != nil {
+			render.Status(r, http.StatusNotAcceptable)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data.Value)
+		if err != nil {
+			render.Status(r, http.StatusNotAcceptable)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+		if key := chi.URLParam(r, "key"); key != "" {
+			data.Key = key
+		}
+		value = decoded
+	}
+	if data.Key == "" {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: EmptyKey.String(), Ok: false})
+		return
+	}
+	ttl := time.Second * time.Duration(data.TTL)
+	getStorage().Set(data.Key, value, ttl)
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Added bitmap with key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: "", Ok: true})
+}
+
+// getBitmap returns binary value. Raw bytes are returned if client accepts 'application/octet-stream',
+// otherwise value is base64 encoded
+func getBitmap(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	value, ok := getStorage().Get(key)
+	if !ok {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: KeyNotFound.String(), Ok: false})
+		return
+	}
+	bitmap, ok := value.([]byte)
+	if !ok {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: NotBitmap.String(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Fetched bitmap with key: "+key, nil))
+	if strings.Contains(r.Header.Get("Accept"), contentTypeOctetStream) {
+		render.Data(w, r, bitmap)
+		return
+	}
+	render.JSON(w, r, Resp{Response: bitmap, Ok: true})
+}
+
+// setBit sets or clears one bit of binary value and returns previous bit
+func setBit(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key    string `json:"key"`
+		Offset uint64 `json:"offset"`
+		Value  int    `json:"value"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	previous, err := getStorage().SetBit(data.Key, data.Offset, data.Value)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Set bit "+strconv.FormatUint(data.Offset, 10)+" for key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: previous, Ok: true})
+}
+
+// getBit returns bit of binary value with given key and offset
+func getBit(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	offset, err := strconv.ParseUint(chi.URLParam(r, "offset"), 10, 64)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	bit, err := getStorage().GetBit(key, offset)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: bit, Ok: true})
+}
+
+// queryInt returns integer query parameter or default value if parameter is absent
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// bitCount returns number of set bits in binary value. Optional 'start' and 'end' query
+// parameters limit bytes range
+func bitCount(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	start, err := queryInt(r, "start", 0)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	end, err := queryInt(r, "end", -1)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	count, err := getStorage().BitCount(key, start, end)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: count, Ok: true})
+}
+
+// bitPos returns position of first bit with given value. Optional 'start' and 'end' query
+// parameters limit bytes range
+func bitPos(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	bit, err := strconv.Atoi(chi.URLParam(r, "bit"))
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	start, err := queryInt(r, "start", 0)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	var end *int
+	if r.URL.Query().Get("end") != "" {
+		endValue, err := queryInt(r, "end", -1)
+		if err != nil {
+			render.Status(r, http.StatusNotAcceptable)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+		end = &endValue
+	}
+	pos, err := getStorage().BitPos(key, bit, start, end)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: pos, Ok: true})
+}
+
+// bitOp performs AND/OR/XOR/NOT between binary values and stores result to destination key
+func bitOp(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Operation string   `json:"operation"`
+		DestKey   string   `json:"destkey"`
+		Keys      []string `json:"keys"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	length, err := getStorage().BitOp(strings.ToUpper(data.Operation), data.DestKey, data.Keys...)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Stored "+data.Operation+" result to key: "+data.DestKey, nil))
+	render.JSON(w, r, Resp{Response: length, Ok: true})
+}
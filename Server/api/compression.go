@@ -0,0 +1,77 @@
+package api
+
+import (
+	"github.com/Labutin/KVServer/Server/api/persist"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// compression keeps compressor of values in memory, which is attached to every new storage
+type compression struct {
+	sync.Mutex
+	compressor *kvstorage.Compressor
+}
+
+var memoryCompression = &compression{}
+
+// compressionStats are totals of values compressed in memory and in persistent storage.
+// Nil means that values are not compressed
+type compressionStats struct {
+	Memory  *kvstorage.CompressionStats `json:"memory"`
+	Persist *kvstorage.CompressionStats `json:"persist"`
+}
+
+// StartCompression makes storage keep strings, lists and dicts not smaller than threshold (in bytes)
+// compressed with given gzip level. Values stored before are not changed
+func StartCompression(threshold, level int) error {
+	compressor, err := kvstorage.NewCompressor(threshold, level)
+	if err != nil {
+		return err
+	}
+	memoryCompression.Lock()
+	memoryCompression.compressor = compressor
+	memoryCompression.Unlock()
+	memoryCompression.attach(getStorage())
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Compression of values from "+strconv.Itoa(threshold)+" bytes started", nil))
+	return nil
+}
+
+// StopCompression stops compressing new values. Compressed values stay compressed
+func StopCompression() {
+	memoryCompression.Lock()
+	memoryCompression.compressor = nil
+	memoryCompression.Unlock()
+	memoryCompression.attach(getStorage())
+}
+
+// attach sets compressor of storage
+func (t *compression) attach(storage *kvstorage.Storage) {
+	if storage == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	storage.SetCompressor(t.compressor)
+}
+
+// getCompressionStats returns compression ratio and time of values in memory and in persistent storage
+func getCompressionStats(w http.ResponseWriter, r *http.Request) {
+	stats := compressionStats{}
+	memoryCompression.Lock()
+	if memoryCompression.compressor != nil {
+		memory := memoryCompression.compressor.Stats()
+		stats.Memory = &memory
+	}
+	memoryCompression.Unlock()
+	if reporter, ok := persistStorage.(persist.CompressionReporter); ok {
+		if persisted, ok := reporter.CompressionStats(); ok {
+			stats.Persist = &persisted
+		}
+	}
+	render.JSON(w, r, Resp{Response: stats, Ok: true})
+}
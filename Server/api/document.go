@@ -0,0 +1,75 @@
+package api
+
+import (
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Patch content types
+const (
+	contentTypeJSONPatch  = "application/json-patch+json"
+	contentTypeMergePatch = "application/merge-patch+json"
+)
+
+// getDocument returns element of stored document by JSON path from 'path' query parameter (whole document by default)
+func getDocument(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	path := r.URL.Query().Get("path")
+	var res Resp
+	if value, err := getStorage().GetPath(key, path); err != nil {
+		render.Status(r, http.StatusNotFound)
+		res.Ok = false
+		res.Error = err.Error()
+	} else {
+		res = Resp{Response: value, Ok: true}
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Fetched document with key: "+key+" and path: "+path, nil))
+	render.JSON(w, r, res)
+}
+
+// patchDocument applies JSON Patch (RFC 6902) or JSON Merge Patch (RFC 7386) depending on request content type.
+// JSON Patch is used by default. Patched document is checked against schema registered for key prefix
+func patchDocument(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	check := func(document interface{}) error {
+		return checkValue(key, document)
+	}
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeMergePatch) {
+		var patch interface{}
+		if err := bindJSON(r.Body, &patch); err != nil {
+			render.Status(r, http.StatusNotAcceptable)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+		err = getStorage().MergePatch(key, patch, check)
+	} else {
+		var operations []kvstorage.PatchOperation
+		if err := bindJSON(r.Body, &operations); err != nil {
+			render.Status(r, http.StatusNotAcceptable)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+		err = getStorage().Patch(key, operations, check)
+	}
+	if invalid, ok := err.(invalidValue); ok {
+		renderInvalidValue(w, r, invalid)
+		return
+	}
+	if err != nil {
+		if err.Error() == KeyNotFound.String() {
+			render.Status(r, http.StatusNotFound)
+		} else {
+			render.Status(r, http.StatusConflict)
+		}
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Patched document with key: "+key, nil))
+	render.JSON(w, r, Resp{Response: "", Ok: true})
+}
@@ -5,13 +5,53 @@ type Errors uint8
 // Errors (codes)
 const (
 	KeyNotFound = Errors(iota)
+	EmptyKey
+	NotBitmap
+	ValidationFailed
+	SchemaNotFound
+	SaveInProgress
+	NotReady
+	UnknownPersistMode
+	PersistModeNotSupported
+	PersistModeStarted
+	InvalidPersistModeOptions
+	ReadThroughNotSupported
+	UnknownLoadMode
+	LoadInProgress
+	JobNotFound
+	PersistUnhealthy
+	EncryptionNotConfigured
+	GenerationsNotSupported
+	GenerationNotFound
 )
 
 // Errors in string format
 var errors = map[Errors]string{
-	KeyNotFound: "Key not found",
+	KeyNotFound:               "Key not found",
+	EmptyKey:                  "Key is empty",
+	NotBitmap:                 "Value not Bitmap",
+	ValidationFailed:          "Validation failed",
+	SchemaNotFound:            "Schema not found",
+	SaveInProgress:            "Save already in progress",
+	NotReady:                  "Data is loading",
+	UnknownPersistMode:        "Unknown persistence mode",
+	PersistModeNotSupported:   "Persistent storage doesn't support persistence mode",
+	PersistModeStarted:        "Persistence mode is already started",
+	InvalidPersistModeOptions: "Queue size, batch size and flush interval must be positive",
+	ReadThroughNotSupported:   "Persistent storage doesn't support read-through",
+	UnknownLoadMode:           "Unknown load mode",
+	LoadInProgress:            "Load already in progress",
+	JobNotFound:               "Job not found",
+	PersistUnhealthy:          "Persistent storage is unavailable",
+	EncryptionNotConfigured:   "Persistent storage doesn't encrypt values",
+	GenerationsNotSupported:   "Persistent storage doesn't keep snapshot generations",
+	GenerationNotFound:        "Snapshot generation not found",
 }
 
 func (t Errors) String() string {
 	return errors[t]
 }
+
+func (t Errors) Error() string {
+	return t.String()
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/api/persist"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi/render"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// exportData streams keys with prefix given in query as newline-delimited JSON records
+func exportData(w http.ResponseWriter, r *http.Request) {
+	if !IsReady() {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, Resp{Error: NotReady.String(), Ok: false})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	count, err := persist.ExportNDJSON(r.Context(), w, getStorage(), r.URL.Query().Get("prefix"))
+	if err != nil {
+		// Response is already started, so export is just cut
+		log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_NAME, "Export stopped after "+strconv.Itoa(count)+" keys", err))
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Exported "+strconv.Itoa(count)+" keys", nil))
+}
+
+// importData loads newline-delimited JSON records from request body. Mode (merge by default, merge-keep
+// or replace) and key prefix are given in query like for loadFromDb. In merge modes records are applied one by one
+// as they are read, so records applied before broken or invalid record are kept. In replace mode import is applied
+// as a whole after all records are read and checked against schemas. Returns number of applied keys
+func importData(w http.ResponseWriter, r *http.Request) {
+	if !IsReady() {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, Resp{Error: NotReady.String(), Ok: false})
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = LOAD_MODE_MERGE
+	}
+	prefix := r.URL.Query().Get("prefix")
+	var count int
+	var err error
+	if mode == LOAD_MODE_MERGE || mode == LOAD_MODE_MERGE_KEEP {
+		count, err = importRecords(r.Context(), r.Body, mode, prefix)
+	} else {
+		err = restore(r.Context(), mode, prefix, func(ctx context.Context, loaded *kvstorage.Storage) error {
+			if _, err := persist.ImportNDJSON(ctx, r.Body, loaded); err != nil {
+				return err
+			}
+			for _, key := range loaded.Keys() {
+				if strings.HasPrefix(key, prefix) {
+					count++
+				}
+			}
+			return checkLoaded(loaded, prefix)
+		})
+	}
+	if invalid, ok := err.(invalidValue); ok {
+		log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_NAME, "Import stopped after "+strconv.Itoa(count)+" keys", err))
+		renderInvalidValue(w, r, invalid)
+		return
+	}
+	if err != nil {
+		log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_NAME, "Import stopped after "+strconv.Itoa(count)+" keys", err))
+		switch err.(type) {
+		case persist.BrokenRecord:
+			render.Status(r, http.StatusBadRequest)
+		default:
+			switch err {
+			case LoadInProgress:
+				render.Status(r, http.StatusConflict)
+			case UnknownLoadMode:
+				render.Status(r, http.StatusBadRequest)
+			default:
+				render.Status(r, http.StatusInternalServerError)
+			}
+		}
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Imported "+strconv.Itoa(count)+" keys", nil))
+	render.JSON(w, r, Resp{Response: count, Ok: true})
+}
+
+// importRecords applies records with prefix to current storage as they are read. In merge-keep mode only absent
+// keys are added. Values are checked against schemas like written by clients. Returns number of applied keys
+func importRecords(ctx context.Context, reader io.Reader, mode, prefix string) (int, error) {
+	if !atomic.CompareAndSwapInt32(&loading, 0, 1) {
+		return 0, LoadInProgress
+	}
+	defer atomic.StoreInt32(&loading, 0)
+	storage := getStorage()
+	count := 0
+	err := persist.ReadNDJSON(ctx, reader, func(key string, value interface{}, ttl time.Duration) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		if err := checkValue(key, value); err != nil {
+			return err
+		}
+		if mode == LOAD_MODE_MERGE_KEEP {
+			if storage.SetIfAbsent(key, value, ttl) {
+				count++
+			}
+			return nil
+		}
+		storage.Set(key, value, ttl)
+		count++
+		return nil
+	})
+	// Applied keys are written like changed by requests
+	if writeErr := writes.afterWrite(); err == nil {
+		err = writeErr
+	}
+	return count, err
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/api/persist"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi"
+	"github.com/pressly/chi/render"
+	"net/http"
+)
+
+// getSnapshots returns saved generations of snapshot from the newest one
+func getSnapshots(w http.ResponseWriter, r *http.Request) {
+	generationStorage, ok := persistStorage.(persist.GenerationStorage)
+	if !ok {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, Resp{Error: GenerationsNotSupported.String(), Ok: false})
+		return
+	}
+	generations, err := generationStorage.Generations()
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: generations, Ok: true})
+}
+
+// startRestoreJob starts restoring generation of snapshot in background. Mode (replace by default, merge
+// or merge-keep) and key prefix are given in query like for loadFromDb
+func startRestoreJob(w http.ResponseWriter, r *http.Request) {
+	generationStorage, ok := persistStorage.(persist.GenerationStorage)
+	if !ok {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, Resp{Error: GenerationsNotSupported.String(), Ok: false})
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = LOAD_MODE_REPLACE
+	}
+	if mode != LOAD_MODE_REPLACE && mode != LOAD_MODE_MERGE && mode != LOAD_MODE_MERGE_KEEP {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, Resp{Error: UnknownLoadMode.String(), Ok: false})
+		return
+	}
+	id := chi.URLParam(r, "id")
+	generations, err := generationStorage.Generations()
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	if !hasGeneration(generations, id) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: GenerationNotFound.String(), Ok: false})
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	status := jobs.start(JOB_TYPE_RESTORE, func(ctx context.Context) error {
+		return restore(ctx, mode, prefix, func(ctx context.Context, loaded *kvstorage.Storage) error {
+			return generationStorage.RestoreGeneration(ctx, id, loaded)
+		})
+	})
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, Resp{Response: status, Ok: true})
+}
+
+// hasGeneration checks that generation with given ID is saved
+func hasGeneration(generations []persist.Generation, id string) bool {
+	for _, generation := range generations {
+		if generation.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// addGeo adds members with coordinates to geo set
+func addGeo(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key     string                `json:"key"`
+		Members []kvstorage.GeoMember `json:"members"`
+		TTL     int64                 `json:"ttl"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	ttl := time.Second * time.Duration(data.TTL)
+	added, err := getStorage().GeoAdd(data.Key, data.Members, ttl)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Added geo members with key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: added, Ok: true})
+}
+
+// removeGeo removes members from geo set
+func removeGeo(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key     string   `json:"key"`
+		Members []string `json:"members"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	removed, err := getStorage().GeoRemove(data.Key, data.Members...)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Removed geo members with key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: removed, Ok: true})
+}
+
+// getGeoPos returns coordinates of geo set member
+func getGeoPos(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	member, err := getStorage().GeoPos(key, chi.URLParam(r, "member"))
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: member, Ok: true})
+}
+
+// getGeoDist returns distance between two members. Optional 'unit' query parameter is one of m, km, mi, ft
+func getGeoDist(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	dist, err := getStorage().GeoDist(key, chi.URLParam(r, "member1"), chi.URLParam(r, "member2"), r.URL.Query().Get("unit"))
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: dist, Ok: true})
+}
+
+// queryFloat returns float query parameter
+func queryFloat(r *http.Request, name string) (float64, error) {
+	return strconv.ParseFloat(r.URL.Query().Get(name), 64)
+}
+
+// geoCenter returns search center from 'member' or 'lon' and 'lat' query parameters
+func geoCenter(r *http.Request) (float64, float64, error) {
+	key := chi.URLParam(r, "key")
+	if name := r.URL.Query().Get("member"); name != "" {
+		member, err := getStorage().GeoPos(key, name)
+		if err != nil {
+			return 0, 0, err
+		}
+		return member.Longitude, member.Latitude, nil
+	}
+	lon, err := queryFloat(r, "lon")
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, err := queryFloat(r, "lat")
+	if err != nil {
+		return 0, 0, err
+	}
+	return lon, lat, nil
+}
+
+// geoRadius returns members within 'radius' from center sorted by distance
+func geoRadius(w http.ResponseWriter, r *http.Request) {
+	lon, lat, err := geoCenter(r)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	radius, err := queryFloat(r, "radius")
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	count, err := queryInt(r, "count", 0)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	results, err := getStorage().GeoRadius(chi.URLParam(r, "key"), lon, lat, radius, r.URL.Query().Get("unit"), count)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: results, Ok: true})
+}
+
+// geoBox returns members within box with 'width' and 'height' around center sorted by distance
+func geoBox(w http.ResponseWriter, r *http.Request) {
+	lon, lat, err := geoCenter(r)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	width, err := queryFloat(r, "width")
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	height, err := queryFloat(r, "height")
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	count, err := queryInt(r, "count", 0)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	results, err := getStorage().GeoBox(chi.URLParam(r, "key"), lon, lat, width, height, r.URL.Query().Get("unit"), count)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: results, Ok: true})
+}
@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/api/persist"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Job types
+const (
+	JOB_TYPE_SAVE      = "save"
+	JOB_TYPE_LOAD      = "load"
+	JOB_TYPE_REENCRYPT = "reencrypt"
+	JOB_TYPE_RESTORE   = "restore"
+)
+
+// Job states
+const (
+	JOB_STATE_RUNNING   = "running"
+	JOB_STATE_DONE      = "done"
+	JOB_STATE_FAILED    = "failed"
+	JOB_STATE_CANCELLED = "cancelled"
+)
+
+// MAX_FINISHED_JOBS is number of finished jobs kept for status requests
+const MAX_FINISHED_JOBS = 100
+
+const JOBS_GOROUTINE_NAME = "jobs"
+
+// jobStatus is state of background save or load
+type jobStatus struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	State     string    `json:"state"`
+	Processed int64     `json:"processed"`
+	Error     string    `json:"error"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Duration  string    `json:"duration"`
+}
+
+// job is background save or load
+type job struct {
+	number   int64
+	status   jobStatus
+	progress *persist.Progress
+	cancel   context.CancelFunc
+}
+
+// jobList keeps running jobs and last finished ones
+type jobList struct {
+	sync.Mutex
+	lastID   int64
+	jobs     map[string]*job
+	finished []string
+	wg       sync.WaitGroup
+}
+
+var jobs = &jobList{jobs: map[string]*job{}}
+
+// start runs function in background and returns status of new job
+func (t *jobList) start(jobType string, run func(ctx context.Context) error) jobStatus {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, progress := persist.WithProgress(ctx)
+	t.Lock()
+	defer t.Unlock()
+	t.lastID++
+	j := &job{
+		number: t.lastID,
+		status: jobStatus{
+			ID:      strconv.FormatInt(t.lastID, 10),
+			Type:    jobType,
+			State:   JOB_STATE_RUNNING,
+			Started: time.Now(),
+		},
+		progress: progress,
+		cancel:   cancel,
+	}
+	t.jobs[j.status.ID] = j
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		err := run(ctx)
+		cancel()
+		t.finish(j, err)
+	}()
+	log.Println(logs.MakeLogString(logs.INFO, JOBS_GOROUTINE_NAME, "Started "+jobType+" job "+j.status.ID, nil))
+	return j.getStatus()
+}
+
+// finish records result of job and forgets the oldest finished jobs
+func (t *jobList) finish(j *job, err error) {
+	t.Lock()
+	defer t.Unlock()
+	j.status.Processed = j.progress.Processed()
+	j.status.Finished = time.Now()
+	j.status.Duration = j.status.Finished.Sub(j.status.Started).String()
+	switch err {
+	case nil:
+		j.status.State = JOB_STATE_DONE
+	case context.Canceled:
+		j.status.State = JOB_STATE_CANCELLED
+	default:
+		j.status.State = JOB_STATE_FAILED
+		j.status.Error = err.Error()
+		log.Println(logs.MakeLogString(logs.ERROR, JOBS_GOROUTINE_NAME, j.status.Type+" job "+j.status.ID+" failed", err))
+	}
+	t.finished = append(t.finished, j.status.ID)
+	if len(t.finished) > MAX_FINISHED_JOBS {
+		delete(t.jobs, t.finished[0])
+		t.finished = t.finished[1:]
+	}
+}
+
+// getStatus returns copy of job status. Must be called under lock of job list
+func (t *job) getStatus() jobStatus {
+	status := t.status
+	if status.State == JOB_STATE_RUNNING {
+		status.Processed = t.progress.Processed()
+		status.Duration = time.Since(status.Started).String()
+	}
+	return status
+}
+
+// get returns status of job
+func (t *jobList) get(id string) (jobStatus, bool) {
+	t.Lock()
+	defer t.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return jobStatus{}, false
+	}
+	return j.getStatus(), true
+}
+
+// list returns statuses of all known jobs ordered by start
+func (t *jobList) list() []jobStatus {
+	t.Lock()
+	defer t.Unlock()
+	list := make([]*job, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		list = append(list, j)
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].number < list[k].number })
+	statuses := make([]jobStatus, 0, len(list))
+	for _, j := range list {
+		statuses = append(statuses, j.getStatus())
+	}
+	return statuses
+}
+
+// cancel stops job. Finished job is not changed
+func (t *jobList) cancel(id string) (jobStatus, bool) {
+	t.Lock()
+	j, ok := t.jobs[id]
+	t.Unlock()
+	if !ok {
+		return jobStatus{}, false
+	}
+	j.cancel()
+	return t.get(id)
+}
+
+// StopJobs cancels running jobs and waits for them
+func StopJobs() {
+	jobs.Lock()
+	for _, j := range jobs.jobs {
+		j.cancel()
+	}
+	jobs.Unlock()
+	jobs.wg.Wait()
+}
+
+// persistSave saves storage (or only its changes) to persistent storage. Storages which don't support
+// context are checked for cancellation only before start. Storage is saved fully if its changes are not tracked
+func persistSave(ctx context.Context, incremental bool) error {
+	storage := getStorage()
+	incremental = incremental && storage.IsDirtyTracked()
+	if jobStorage, ok := persistStorage.(persist.JobStorage); ok {
+		if incremental {
+			return jobStorage.SaveChangesToDbContext(ctx, storage)
+		}
+		return jobStorage.SaveToDbContext(ctx, storage)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if incremental {
+		return persistStorage.SaveChangesToDb(storage)
+	}
+	return persistStorage.SaveToDb(storage)
+}
+
+// persistLoad loads persistent storage to given storage
+func persistLoad(ctx context.Context, loaded *kvstorage.Storage) error {
+	if jobStorage, ok := persistStorage.(persist.JobStorage); ok {
+		return jobStorage.LoadFromDbContext(ctx, loaded)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return persistStorage.LoadFromDb(loaded)
+}
+
+// startSaveJob starts saving storage in background. Query parameter mode=incremental saves only changes
+func startSaveJob(w http.ResponseWriter, r *http.Request) {
+	incremental := r.URL.Query().Get("mode") == "incremental"
+	status := jobs.start(JOB_TYPE_SAVE, func(ctx context.Context) error {
+		return snapshots.saveContext(ctx, incremental)
+	})
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, Resp{Response: status, Ok: true})
+}
+
+// startLoadJob starts loading storage in background. Query parameters are the same as of loadFromDb
+func startLoadJob(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = LOAD_MODE_REPLACE
+	}
+	if mode != LOAD_MODE_REPLACE && mode != LOAD_MODE_MERGE && mode != LOAD_MODE_MERGE_KEEP {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, Resp{Error: UnknownLoadMode.String(), Ok: false})
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	status := jobs.start(JOB_TYPE_LOAD, func(ctx context.Context) error {
+		return loadContext(ctx, mode, prefix)
+	})
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, Resp{Response: status, Ok: true})
+}
+
+// startReencryptJob starts re-encryption of persisted values with current encryption key in background
+func startReencryptJob(w http.ResponseWriter, r *http.Request) {
+	reencrypter, ok := persistStorage.(persist.Reencrypter)
+	if !ok || !reencrypter.Encrypted() {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, Resp{Error: EncryptionNotConfigured.String(), Ok: false})
+		return
+	}
+	status := jobs.start(JOB_TYPE_REENCRYPT, func(ctx context.Context) error {
+		count, err := reencrypter.Reencrypt(ctx)
+		log.Println(logs.MakeLogString(logs.INFO, JOBS_GOROUTINE_NAME, "Re-encrypted "+strconv.Itoa(count)+" records", nil))
+		return err
+	})
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, Resp{Response: status, Ok: true})
+}
+
+// getJobs returns statuses of running and recently finished jobs
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, Resp{Response: jobs.list(), Ok: true})
+}
+
+// getJob returns status of job
+func getJob(w http.ResponseWriter, r *http.Request) {
+	status, ok := jobs.get(chi.URLParam(r, "id"))
+	if !ok {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: JobNotFound.String(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: status, Ok: true})
+}
+
+// cancelJob cancels job and returns its status
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	status, ok := jobs.cancel(chi.URLParam(r, "id"))
+	if !ok {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: JobNotFound.String(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: status, Ok: true})
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load modes
+const (
+	LOAD_MODE_REPLACE    = "replace"
+	LOAD_MODE_MERGE      = "merge"
+	LOAD_MODE_MERGE_KEEP = "merge-keep"
+)
+
+// loading is 1 while data is loaded from persistent storage
+var loading int32
+
+// Load restores data from persistent storage without stopping requests. Data is loaded to separate storage first.
+// In replace mode loaded storage replaces current one (or only keys with prefix are replaced), in merge mode
+// loaded keys overwrite current ones, in merge-keep mode only absent keys are added.
+// Empty prefix means all keys
+func Load(mode, prefix string) error {
+	return loadContext(context.Background(), mode, prefix)
+}
+
+// loadContext is Load which can be cancelled. Cancelled load doesn't change current storage
+func loadContext(ctx context.Context, mode, prefix string) error {
+	if err := restore(ctx, mode, prefix, persistLoad); err != nil {
+		return err
+	}
+	return LoadSchemas()
+}
+
+// restore fills separate storage and applies it to current one according to load mode.
+// Only one restore runs at a time
+func restore(ctx context.Context, mode, prefix string, fill func(context.Context, *kvstorage.Storage) error) error {
+	if mode != LOAD_MODE_REPLACE && mode != LOAD_MODE_MERGE && mode != LOAD_MODE_MERGE_KEEP {
+		return UnknownLoadMode
+	}
+	if !atomic.CompareAndSwapInt32(&loading, 0, 1) {
+		return LoadInProgress
+	}
+	defer atomic.StoreInt32(&loading, 0)
+	swap := mode == LOAD_MODE_REPLACE && prefix == ""
+	var written *writtenKeys
+	if swap {
+		written = followWrites(getStorage())
+		defer written.stop()
+	}
+	loaded := kvstorage.NewKVStorage(chuncks, swap)
+	memoryCompression.attach(loaded)
+	// Persistent storage which logs changes (e.g. append only file) keeps logging current storage while loaded
+	// one is filled, so keys written meanwhile are logged before they are copied to loaded storage
+	err := fill(ctx, loaded)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && !swap {
+		// Merged values are written to current storage, so they must match schemas like written by clients
+		err = checkLoaded(loaded, prefix)
+	}
+	if err != nil {
+		if swap {
+			loaded.StopTTLProcessing()
+		}
+		return err
+	}
+	if swap {
+		swapStorage(loaded, written)
+	} else {
+		merge(loaded, mode, prefix)
+		// Merged keys are written like changed by requests
+		if err := writes.afterWrite(); err != nil {
+			return err
+		}
+	}
+	if isPersistedHeld() {
+		holdPersisted(false)
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Data restored in "+mode+" mode with prefix \""+prefix+"\"", nil))
+	return nil
+}
+
+// swapStorage makes loaded storage current. Keys written to current storage while loaded one was filled
+// are copied to it, modifying requests wait until storage is swapped
+func swapStorage(loaded *kvstorage.Storage, written *writtenKeys) {
+	swapMutex.Lock()
+	defer swapMutex.Unlock()
+	written.replay(loaded)
+	useStorage(loaded)
+}
+
+// writtenKeys remembers keys changed or deleted in storage
+type writtenKeys struct {
+	sync.Mutex
+	storage    *kvstorage.Storage
+	listenerID int
+	keys       map[string]bool
+}
+
+// followWrites starts remembering keys written to storage
+func followWrites(storage *kvstorage.Storage) *writtenKeys {
+	written := &writtenKeys{storage: storage, keys: map[string]bool{}}
+	written.listenerID = storage.AddChangeListener(func(key string, changed bool) {
+		written.Lock()
+		written.keys[key] = true
+		written.Unlock()
+	})
+	return written
+}
+
+// stop stops remembering written keys
+func (t *writtenKeys) stop() {
+	t.storage.RemoveChangeListener(t.listenerID)
+}
+
+// replay copies current state of written keys to given storage
+func (t *writtenKeys) replay(storage *kvstorage.Storage) {
+	t.Lock()
+	defer t.Unlock()
+	currentTime := time.Now().Unix()
+	for key := range t.keys {
+		value, ttl, ok := t.storage.GetWithTTL(key)
+		if !ok || (ttl > 0 && ttl <= currentTime) {
+			storage.Remove(key)
+			continue
+		}
+		var duration time.Duration
+		if ttl > 0 {
+			duration = time.Unix(ttl, 0).Sub(time.Now())
+		}
+		storage.Set(key, value, duration)
+	}
+}
+
+// merge copies keys with prefix from loaded storage to current one according to load mode
+func merge(loaded *kvstorage.Storage, mode, prefix string) {
+	storage := getStorage()
+	currentTime := time.Now().Unix()
+	keys := map[string]bool{}
+	for _, key := range loaded.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		value, ttl, ok := loaded.GetWithTTL(key)
+		if !ok || (ttl > 0 && ttl <= currentTime) {
+			continue
+		}
+		keys[key] = true
+		var duration time.Duration
+		if ttl > 0 {
+			duration = time.Unix(ttl, 0).Sub(time.Now())
+		}
+		if mode == LOAD_MODE_MERGE_KEEP {
+			storage.SetIfAbsent(key, value, duration)
+		} else {
+			storage.Set(key, value, duration)
+		}
+	}
+	if mode != LOAD_MODE_REPLACE {
+		return
+	}
+	for _, key := range storage.Keys() {
+		if strings.HasPrefix(key, prefix) && !keys[key] {
+			storage.Remove(key)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fsync policies of append only file
+const (
+	FSYNC_ALWAYS   = "always"
+	FSYNC_EVERYSEC = "everysec"
+	FSYNC_NO       = "no"
+)
+
+const (
+	AOF_OP_SET             = "set"
+	AOF_OP_DEL             = "del"
+	AOF_OP_DELTA           = "delta"
+	AOF_REWRITE_MIN_SIZE   = 64 * 1024 * 1024
+	AOF_REWRITE_PERCENTAGE = 100
+)
+
+// ChangeLogger is persistent storage which logs every change of attached storage
+type ChangeLogger interface {
+	Attach(*kvstorage.Storage)
+}
+
+// AutoCompactor is persistent storage which replaces its data with attached storage in background
+type AutoCompactor interface {
+	SetAutoCompaction(enabled bool)
+}
+
+// aofRecord is one line of append only file. Record keeps state of key after change
+// or delta of partial change (e.g. stream append), so that large values aren't written on every change.
+// Value or delta of encrypted record is sealed, operation, key, type and TTL stay readable
+type aofRecord struct {
+	Op     string           `json:"op"`
+	Key    string           `json:"key"`
+	Type   string           `json:"type,omitempty"`
+	TTL    int64            `json:"ttl,omitempty"`
+	Value  json.RawMessage  `json:"value,omitempty"`
+	Delta  *kvstorage.Delta `json:"delta,omitempty"`
+	Sealed *envelope        `json:"sealed,omitempty"`
+}
+
+// AOFStorage appends every change of storage to local file and replays it on load
+type AOFStorage struct {
+	sync.Mutex
+	path           string
+	fsync          string
+	file           *os.File
+	size           int64
+	baseSize       int64
+	err            error
+	storage        *kvstorage.Storage
+	listenerID     int
+	rewriteMutex   sync.Mutex
+	rewriting      int32
+	noAutoRewrite  int32
+	rewriteKeys    map[string]bool
+	done           chan struct{}
+	rewriteMinSize int64
+	keyring        *Keyring
+}
+
+func init() {
+	RegisterBackend("aof", openAOFURL)
+}
+
+// openAOFURL opens append only file given as aof:///path/to/file[?fsync=always|everysec|no].
+// Fsync policy of backend options is used if URL has none. Values are encrypted with keyring of backend options
+func openAOFURL(rawURL string, options BackendOptions) (PersistStorage, error) {
+	path, query, err := parseFileURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	fsync := query.Get("fsync")
+	if fsync == "" {
+		fsync = options.AOFFsync
+	}
+	if fsync == "" {
+		fsync = FSYNC_EVERYSEC
+	}
+	aof, err := NewAOFStorage(path, fsync)
+	if err != nil {
+		return nil, err
+	}
+	aof.SetKeyring(options.Keyring)
+	return aof, nil
+}
+
+// NewAOFStorage opens (or creates) append only file. fsync is one of 'always', 'everysec' and 'no'.
+// Incomplete last record (e.g. after crash) is dropped, so that records are appended after complete ones
+func NewAOFStorage(path, fsync string) (*AOFStorage, error) {
+	if fsync != FSYNC_ALWAYS && fsync != FSYNC_EVERYSEC && fsync != FSYNC_NO {
+		return nil, errors.New("Unknown fsync policy: " + fsync)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := dropIncompleteRecord(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	aof := &AOFStorage{
+		path:           path,
+		fsync:          fsync,
+		file:           file,
+		size:           size,
+		baseSize:       size,
+		done:           make(chan struct{}),
+		rewriteMinSize: AOF_REWRITE_MIN_SIZE,
+	}
+	if fsync == FSYNC_EVERYSEC {
+		go aof.syncLoop()
+	}
+	return aof, nil
+}
+
+// dropIncompleteRecord cuts file after its last complete line. Returns size of file
+func dropIncompleteRecord(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	buffer := make([]byte, 4096)
+	size := int64(0)
+	for end := info.Size(); end > 0; {
+		start := end - int64(len(buffer))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buffer[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			size = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if size == info.Size() {
+		return size, nil
+	}
+	log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Dropped incomplete record at offset "+strconv.FormatInt(size, 10), nil))
+	return size, file.Truncate(size)
+}
+
+// SetAutoCompaction enables or disables background rewrite of grown file. Explicit save still rewrites it
+func (t *AOFStorage) SetAutoCompaction(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&t.noAutoRewrite, 0)
+	} else {
+		atomic.StoreInt32(&t.noAutoRewrite, 1)
+	}
+}
+
+// SetKeyring makes storage encrypt records it writes. Must be called before storage is used
+func (t *AOFStorage) SetKeyring(keyring *Keyring) {
+	t.keyring = keyring
+}
+
+// syncLoop flushes file to disk every second
+func (t *AOFStorage) syncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.Lock()
+			if err := t.file.Sync(); err != nil {
+				t.fail(err)
+			}
+			t.Unlock()
+		}
+	}
+}
+
+// fail remembers write error. It is returned by next save
+func (t *AOFStorage) fail(err error) {
+	log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_ID, "Can't write append only file", err))
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// Attach starts logging changes of storage. Previously attached storage is detached without gap,
+// so that no change of storage which is attached again is missed
+func (t *AOFStorage) Attach(storage *kvstorage.Storage) {
+	t.Lock()
+	defer t.Unlock()
+	if t.storage == storage {
+		return
+	}
+	if t.storage != nil {
+		t.storage.RemoveChangeListener(t.listenerID)
+	}
+	t.storage = storage
+	t.listenerID = storage.AddDeltaListener(func(key string, changed bool, delta *kvstorage.Delta) {
+		t.logChange(storage, key, delta)
+	})
+}
+
+// detach stops logging changes of attached storage
+func (t *AOFStorage) detach() {
+	t.Lock()
+	defer t.Unlock()
+	if t.storage != nil {
+		t.storage.RemoveChangeListener(t.listenerID)
+		t.storage = nil
+	}
+}
+
+// logChange appends delta or current state of key to file. State is read under lock so that the last record of key
+// is never older than its value in storage
+func (t *AOFStorage) logChange(storage *kvstorage.Storage, key string, delta *kvstorage.Delta) {
+	t.Lock()
+	var line []byte
+	var err error
+	if delta != nil {
+		line, err = deltaLine(key, delta, t.keyring)
+	} else {
+		line, err = recordLine(storage, key, t.keyring)
+	}
+	if err != nil {
+		t.Unlock()
+		log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_ID, "Can't encode key: "+key, err))
+		return
+	}
+	if t.rewriteKeys != nil {
+		t.rewriteKeys[key] = true
+	}
+	n, err := t.file.Write(line)
+	if err != nil && n > 0 {
+		// Partial record would break replay of records appended after it
+		if truncateErr := t.file.Truncate(t.size); truncateErr != nil {
+			t.size += int64(n)
+		}
+	} else {
+		t.size += int64(n)
+	}
+	if err == nil && t.fsync == FSYNC_ALWAYS {
+		err = t.file.Sync()
+	}
+	if err != nil {
+		t.fail(err)
+	}
+	needRewrite := t.size >= t.rewriteMinSize && t.size >= t.baseSize*(100+AOF_REWRITE_PERCENTAGE)/100
+	t.Unlock()
+	if needRewrite && atomic.LoadInt32(&t.noAutoRewrite) == 0 && atomic.CompareAndSwapInt32(&t.rewriting, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&t.rewriting, 0)
+			if _, err := t.rewrite(context.Background(), storage); err != nil {
+				log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_ID, "Background rewrite of append only file failed", err))
+			}
+		}()
+	}
+}
+
+// recordLine encodes current state of key as one line of file. Value is encrypted if keyring is given
+func recordLine(storage *kvstorage.Storage, key string, keyring *Keyring) ([]byte, error) {
+	record := aofRecord{Op: AOF_OP_DEL, Key: key}
+	if value, ttl, ok := storage.GetWithTTL(key); ok {
+		jsonRecord, err := newJSONRecord(key, value, ttl)
+		if err != nil {
+			return nil, err
+		}
+		record = aofRecord{Op: AOF_OP_SET, Key: key, Type: jsonRecord.Type, TTL: ttl, Value: jsonRecord.Value}
+	}
+	return encodeLine(record, keyring)
+}
+
+// deltaLine encodes partial change of key as one line of file. Delta is encrypted if keyring is given
+func deltaLine(key string, delta *kvstorage.Delta, keyring *Keyring) ([]byte, error) {
+	return encodeLine(aofRecord{Op: AOF_OP_DELTA, Key: key, Delta: delta}, keyring)
+}
+
+// encodeLine seals value or delta of record with keyring (if it is given) and encodes record as one line of file
+func encodeLine(record aofRecord, keyring *Keyring) ([]byte, error) {
+	if keyring != nil && record.Op != AOF_OP_DEL {
+		plaintext := []byte(record.Value)
+		if record.Op == AOF_OP_DELTA {
+			var err error
+			if plaintext, err = json.Marshal(record.Delta); err != nil {
+				return nil, err
+			}
+		}
+		sealed, err := keyring.seal(plaintext, record.Key)
+		if err != nil {
+			return nil, err
+		}
+		record.Value, record.Delta, record.Sealed = nil, nil, &sealed
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// openRecord decrypts value or delta of encrypted record
+func openRecord(record *aofRecord, keyring *Keyring) error {
+	if record.Sealed == nil {
+		return nil
+	}
+	if keyring == nil {
+		return errors.New("Record is encrypted, but encryption keys are not configured")
+	}
+	plaintext, err := keyring.open(*record.Sealed, record.Key)
+	if err != nil {
+		return err
+	}
+	if record.Op != AOF_OP_DELTA {
+		record.Value = plaintext
+		return nil
+	}
+	record.Delta = &kvstorage.Delta{}
+	return unmarshalJSON(plaintext, record.Delta)
+}
+
+// rewrite writes compact file with current state of storage and atomically replaces the log with it.
+// Changes made during rewrite are appended to the old file and then written again to the new one.
+// Cancelled rewrite keeps the old file. Returns number of written records
+func (t *AOFStorage) rewrite(ctx context.Context, storage *kvstorage.Storage) (int, error) {
+	t.rewriteMutex.Lock()
+	defer t.rewriteMutex.Unlock()
+	tmpPath := t.path + TMP_FILE_SUFFIX
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	t.Lock()
+	t.rewriteKeys = map[string]bool{}
+	t.Unlock()
+	writer := bufio.NewWriter(tmp)
+	count, err := t.writeRecords(ctx, writer, storage, storage.Keys())
+	t.Lock()
+	defer t.Unlock()
+	if err == nil {
+		keys := make([]string, 0, len(t.rewriteKeys))
+		for key := range t.rewriteKeys {
+			keys = append(keys, key)
+		}
+		var written int
+		written, err = t.writeRecords(ctx, writer, storage, keys)
+		count += written
+	}
+	t.rewriteKeys = nil
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = tmp.Stat()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, t.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	syncDir(filepath.Dir(t.path))
+	t.file.Close()
+	t.file = tmp
+	t.size = info.Size()
+	t.baseSize = info.Size()
+	t.err = nil
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_ID, "Append only file rewritten, size "+strconv.FormatInt(t.size, 10), nil))
+	return count, nil
+}
+
+// writeRecords writes current state of keys until context is cancelled. Returns number of written records
+func (t *AOFStorage) writeRecords(ctx context.Context, writer io.Writer, storage *kvstorage.Storage, keys []string) (int, error) {
+	for i, key := range keys {
+		if err := keyDone(ctx); err != nil {
+			return i, err
+		}
+		line, err := recordLine(storage, key, t.keyring)
+		if err != nil {
+			return i, err
+		}
+		if _, err := writer.Write(line); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// SaveToDb compacts append only file to current state of storage
+func (t *AOFStorage) SaveToDb(storage *kvstorage.Storage) error {
+	return t.SaveToDbContext(context.Background(), storage)
+}
+
+// SaveToDbContext is SaveToDb which can be cancelled
+func (t *AOFStorage) SaveToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	storage.TakeDirty()
+	_, err := t.rewrite(ctx, storage)
+	return err
+}
+
+// SaveChangesToDb flushes appended changes to disk. Changes are written to file as they happen
+func (t *AOFStorage) SaveChangesToDb(storage *kvstorage.Storage) error {
+	return t.SaveChangesToDbContext(context.Background(), storage)
+}
+
+// SaveChangesToDbContext flushes appended changes like SaveChangesToDb. It is too short to be cancelled
+func (t *AOFStorage) SaveChangesToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	storage.TakeDirty()
+	t.Lock()
+	defer t.Unlock()
+	if err := t.file.Sync(); err != nil {
+		t.fail(err)
+	}
+	err := t.err
+	t.err = nil
+	return err
+}
+
+// LoadFromDb replays append only file into storage and starts logging its changes unless other storage is attached.
+// Attached storage (e.g. current one while data is restored to separate storage) is still logged during load
+// and the file is never changed by load, records appended during load aren't replayed
+func (t *AOFStorage) LoadFromDb(storage *kvstorage.Storage) error {
+	return t.LoadFromDbContext(context.Background(), storage)
+}
+
+// LoadFromDbContext is LoadFromDb which can be cancelled. Records replayed before cancellation stay in storage
+func (t *AOFStorage) LoadFromDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	t.Lock()
+	follow := t.storage == nil || t.storage == storage
+	if t.storage == storage {
+		// Replayed records are in file already
+		t.storage.RemoveChangeListener(t.listenerID)
+		t.storage = nil
+	}
+	file, err := os.Open(t.path)
+	end := t.size
+	t.Unlock()
+	if follow {
+		defer t.Attach(storage)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(io.LimitReader(file, end))
+	var offset int64
+	currentTime := time.Now().Unix()
+	// Deltas of expired key changed the value which is gone, they must not create it again
+	expired := map[string]bool{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return errors.New("Broken append only file at offset " + strconv.FormatInt(offset, 10) + ": incomplete record")
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
+		var record aofRecord
+		if err := unmarshalJSON(line, &record); err != nil {
+			return errors.New("Broken append only file at offset " + strconv.FormatInt(offset, 10) + ": " + err.Error())
+		}
+		if err := openRecord(&record, t.keyring); err != nil {
+			return errors.New("Broken record with key " + record.Key + " at offset " + strconv.FormatInt(offset, 10) + ": " + err.Error())
+		}
+		at := strconv.FormatInt(offset, 10)
+		offset += int64(len(line))
+		if record.Op == AOF_OP_DELTA {
+			if expired[record.Key] || record.Delta == nil {
+				continue
+			}
+			if err := storage.ApplyDelta(record.Key, *record.Delta); err != nil {
+				return errors.New("Broken delta with key " + record.Key + " at offset " + at + ": " + err.Error())
+			}
+			continue
+		}
+		delete(expired, record.Key)
+		if record.Op == AOF_OP_DEL {
+			storage.Remove(record.Key)
+			continue
+		}
+		if record.TTL > 0 && record.TTL <= currentTime {
+			expired[record.Key] = true
+			storage.Remove(record.Key)
+			continue
+		}
+		value, err := decodeValue(record.Type, record.Value)
+		if err != nil {
+			return errors.New("Broken record with key " + record.Key + " at offset " + at + ": " + err.Error())
+		}
+		var ttl time.Duration
+		if record.TTL > 0 {
+			ttl = time.Unix(record.TTL, 0).Sub(time.Now())
+		}
+		storage.Set(record.Key, value, ttl)
+	}
+	storage.TakeDirty()
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_ID, "Replayed append only file "+t.path, nil))
+	return nil
+}
+
+// SaveSchemas replaces JSON Schemas stored next to append only file
+func (t *AOFStorage) SaveSchemas(schemas map[string]interface{}) error {
+	return saveSchemasFile(t.path+SCHEMAS_FILE_SUFFIX, schemas)
+}
+
+// LoadSchemas returns JSON Schemas stored next to append only file
+func (t *AOFStorage) LoadSchemas() (map[string]interface{}, error) {
+	return loadSchemasFile(t.path + SCHEMAS_FILE_SUFFIX)
+}
+
+// Encrypted reports whether records are encrypted
+func (t *AOFStorage) Encrypted() bool {
+	return t.keyring != nil
+}
+
+// Reencrypt rewrites append only file with attached storage, so that all records are encrypted with current key.
+// Cancelled re-encryption keeps the old file. Returns number of written records
+func (t *AOFStorage) Reencrypt(ctx context.Context) (int, error) {
+	if t.keyring == nil {
+		return 0, errors.New("Encryption keys are not configured")
+	}
+	t.Lock()
+	storage := t.storage
+	t.Unlock()
+	if storage == nil {
+		return 0, errors.New("Append only file is not loaded")
+	}
+	return t.rewrite(ctx, storage)
+}
+
+// Close stops logging, flushes and closes append only file
+func (t *AOFStorage) Close() error {
+	t.detach()
+	t.Lock()
+	defer t.Unlock()
+	select {
+	case <-t.done:
+		return nil
+	default:
+	}
+	close(t.done)
+	if err := t.file.Sync(); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
@@ -0,0 +1,315 @@
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "aof")
+	require.NoError(t, err)
+	return filepath.Join(dir, "data.aof"), func() { os.RemoveAll(dir) }
+}
+
+func fillStorage(t *testing.T, storage *kvstorage.Storage) {
+	storage.Set("general", "value", 0)
+	storage.Set("list", []interface{}{json.Number("1"), "two"}, 0)
+	storage.Set("dict", map[string]interface{}{"a": map[string]interface{}{"b": true}}, time.Hour)
+	storage.Set("removed", "value", 0)
+	require.NoError(t, storage.Remove("removed"))
+	_, err := storage.SetBit("bitmap", 9, 1)
+	require.NoError(t, err)
+	_, err = storage.GeoAdd("geo", []kvstorage.GeoMember{{Name: "Rome", Longitude: 12.5, Latitude: 41.9}}, 0)
+	require.NoError(t, err)
+	_, err = storage.XAdd("stream", "1-1", map[string]interface{}{"f": "v"}, 0)
+	require.NoError(t, err)
+}
+
+func checkStorage(t *testing.T, storage *kvstorage.Storage) {
+	checkStorageNumber(t, storage, json.Number("1"))
+}
+
+// checkStorageNumber checks storage filled by fillStorage, number in list is loaded as given value
+func checkStorageNumber(t *testing.T, storage *kvstorage.Storage, one interface{}) {
+	value, ok := storage.Get("general")
+	require.True(t, ok)
+	require.Equal(t, "value", value)
+	value, _ = storage.Get("list")
+	require.Equal(t, []interface{}{one, "two"}, value)
+	value, ttl, _ := storage.GetWithTTL("dict")
+	require.Equal(t, map[string]interface{}{"a": map[string]interface{}{"b": true}}, value)
+	require.True(t, ttl > time.Now().Unix())
+	_, ok = storage.Get("removed")
+	require.False(t, ok)
+	bit, err := storage.GetBit("bitmap", 9)
+	require.NoError(t, err)
+	require.Equal(t, 1, bit)
+	member, err := storage.GeoPos("geo", "Rome")
+	require.NoError(t, err)
+	require.InDelta(t, 12.5, member.Longitude, 0.0001)
+	entries, err := storage.XRange("stream", kvstorage.StreamIDFirst, kvstorage.StreamIDLast, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "1-1", entries[0].ID)
+}
+
+func TestAOFReplay(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	aof, err := NewAOFStorage(path, FSYNC_ALWAYS)
+	require.NoError(t, err)
+	storage := kvstorage.NewKVStorage(4, false)
+	aof.Attach(storage)
+	fillStorage(t, storage)
+	require.NoError(t, aof.Close())
+
+	aof, err = NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	defer aof.Close()
+	storage = kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(storage))
+	checkStorage(t, storage)
+	changed, deleted := storage.TakeDirty()
+	require.Empty(t, changed)
+	require.Empty(t, deleted)
+}
+
+func TestAOFRewrite(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	aof, err := NewAOFStorage(path, FSYNC_EVERYSEC)
+	require.NoError(t, err)
+	storage := kvstorage.NewKVStorage(4, false)
+	aof.Attach(storage)
+	for i := 0; i < 10; i++ {
+		storage.Set("general", "old", 0)
+	}
+	fillStorage(t, storage)
+	require.NoError(t, aof.SaveToDb(storage))
+	storage.Set("after", "rewrite", 0)
+	require.NoError(t, aof.Close())
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, len(storage.Keys()), strings.Count(string(raw), "\n"))
+
+	aof, err = NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	defer aof.Close()
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+	value, _ := loaded.Get("after")
+	require.Equal(t, "rewrite", value)
+}
+
+func TestAOFAutoCompaction(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	aof, err := NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	defer aof.Close()
+	aof.rewriteMinSize = 1
+	aof.SetAutoCompaction(false)
+	storage := kvstorage.NewKVStorage(4, false)
+	aof.Attach(storage)
+	lines := func() int {
+		raw, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return strings.Count(string(raw), "\n")
+	}
+	for i := 0; i < 10; i++ {
+		storage.Set("a", strconv.Itoa(i), 0)
+	}
+	require.Equal(t, 10, lines())
+
+	aof.SetAutoCompaction(true)
+	storage.Set("a", "last", 0)
+	for i := 0; i < 100 && lines() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 1, lines())
+}
+
+func TestAOFTruncatedRecord(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"op":"set","key":"a","type":"general","value":1}`+"\n"+`{"op":"set","ke`), 0644))
+	aof, err := NewAOFStorage(path, FSYNC_ALWAYS)
+	require.NoError(t, err)
+	defer aof.Close()
+	storage := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(storage))
+	value, _ := storage.Get("a")
+	require.Equal(t, json.Number("1"), value)
+	storage.Set("b", "value", 0)
+
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(loaded))
+	value, _ = loaded.Get("b")
+	require.Equal(t, "value", value)
+}
+
+func TestAOFBrokenRecord(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	for _, broken := range []string{
+		`{"op":"set","key":"b","type":"stream","value":1}`,
+		`{"op":"delta","key":"a","delta":{"op":"xadd","id":"1-1","fields":{"f":"v"}}}`,
+	} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(`{"op":"set","key":"a","type":"general","value":1}`+"\n"+broken+"\n"+
+			`{"op":"set","key":"c","type":"general","value":2}`+"\n"), 0644))
+		aof, err := NewAOFStorage(path, FSYNC_NO)
+		require.NoError(t, err)
+		require.Error(t, aof.LoadFromDb(kvstorage.NewKVStorage(4, false)), broken)
+		require.NoError(t, aof.Close())
+	}
+}
+
+func TestAOFLoadToOtherStorage(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	aof, err := NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	defer aof.Close()
+	storage := kvstorage.NewKVStorage(4, false)
+	aof.Attach(storage)
+	storage.Set("a", "1", 0)
+
+	// Current storage is still logged while data is loaded to other storage
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(loaded))
+	storage.Set("b", "2", 0)
+	loaded.Set("c", "3", 0)
+	value, _ := loaded.Get("a")
+	require.Equal(t, "1", value)
+
+	aof.Attach(loaded)
+	loaded.Set("d", "4", 0)
+	replayed := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(replayed))
+	keys := replayed.Keys()
+	sort.Strings(keys)
+	require.Equal(t, []string{"a", "b", "d"}, keys)
+}
+
+func TestAOFDeltas(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	aof, err := NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	storage := kvstorage.NewKVStorage(4, false)
+	aof.Attach(storage)
+	for i := 0; i < 100; i++ {
+		_, err := storage.XAdd("stream", "*", map[string]interface{}{"n": json.Number(strconv.Itoa(i))}, 50)
+		require.NoError(t, err)
+	}
+	require.NoError(t, storage.XGroupCreate("stream", "g", "0-0"))
+	entries, err := storage.XReadGroup(context.Background(), "stream", "g", "c", kvstorage.StreamIDGroup, 3, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	acked, err := storage.XAck("stream", "g", entries[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, acked)
+	_, err = storage.SetBit("bitmap", 9, 1)
+	require.NoError(t, err)
+	_, err = storage.SetBit("bitmap", 9000, 1)
+	require.NoError(t, err)
+	_, err = storage.GeoAdd("geo", []kvstorage.GeoMember{{Name: "Rome", Longitude: 12.5, Latitude: 41.9}}, 0)
+	require.NoError(t, err)
+	_, err = storage.GeoAdd("geo", []kvstorage.GeoMember{{Name: "Oslo", Longitude: 10.7, Latitude: 59.9}}, 0)
+	require.NoError(t, err)
+	_, err = storage.GeoRemove("geo", "Rome")
+	require.NoError(t, err)
+	require.NoError(t, storage.MergePatch("doc", map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}))
+	require.NoError(t, storage.MergePatch("doc", map[string]interface{}{"b": nil}))
+	require.NoError(t, aof.Close())
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		require.True(t, len(line) < 512, line)
+	}
+	require.Equal(t, 108, strings.Count(string(raw), `"op":"delta"`))
+
+	aof, err = NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	defer aof.Close()
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(loaded))
+	for _, key := range []string{"stream", "bitmap", "geo", "doc"} {
+		want, _ := storage.Get(key)
+		got, _ := loaded.Get(key)
+		require.Equal(t, want, got, key)
+	}
+	pending, err := loaded.XPending("stream", "g", "")
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+}
+
+func TestAOFEncryption(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	keyring, err := NewKeyring("k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	aof, err := NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	aof.SetKeyring(keyring)
+	require.True(t, aof.Encrypted())
+	storage := kvstorage.NewKVStorage(4, false)
+	aof.Attach(storage)
+	fillStorage(t, storage)
+	for _, id := range []string{"1-1", "1-2"} {
+		_, err = storage.XAdd("log", id, map[string]interface{}{"f": "delta"}, 0)
+		require.NoError(t, err)
+	}
+	require.NoError(t, aof.Close())
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"op":"delta"`)
+	require.NotContains(t, string(raw), "value")
+	require.NotContains(t, string(raw), "Rome")
+
+	aof, err = NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	require.Error(t, aof.LoadFromDb(kvstorage.NewKVStorage(4, false)))
+	require.NoError(t, aof.Close())
+
+	// Records are still readable after key rotation and are re-encrypted with new key
+	aof, err = NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	rotated, err := NewKeyring("k2:" + testKey(2, 32) + ",k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	aof.SetKeyring(rotated)
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+	entries, err := loaded.XRange("log", kvstorage.StreamIDFirst, kvstorage.StreamIDLast, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	count, err := aof.Reencrypt(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(loaded.Keys()), count)
+	require.NoError(t, aof.Close())
+
+	aof, err = NewAOFStorage(path, FSYNC_NO)
+	require.NoError(t, err)
+	defer aof.Close()
+	newKeys, err := NewKeyring("k2:" + testKey(2, 32))
+	require.NoError(t, err)
+	aof.SetKeyring(newKeys)
+	loaded = kvstorage.NewKVStorage(4, false)
+	require.NoError(t, aof.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+}
@@ -0,0 +1,140 @@
+package persist
+
+import (
+	"encoding/json"
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"strconv"
+)
+
+// Values which BSON can't tell apart from other types are stored as documents
+// {"_kvtype": <type>, "v": <value>}. Other values are stored as native BSON
+const (
+	bsonTypeField  = "_kvtype"
+	bsonValueField = "v"
+	bsonTypeInt64  = "int64"
+	bsonTypeNumber = "number"
+	bsonTypeDict   = "dict"
+)
+
+// toBsonValue converts JSON-like value to BSON keeping its Go types.
+// int is stored as native integer, int64 is tagged, dicts with type field are escaped.
+// json.Number is stored as native integer or double (and is loaded as int or float64), only numbers which
+// would lose precision are tagged
+func toBsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return bson.M{bsonTypeField: bsonTypeInt64, bsonValueField: v}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, ok := exactFloat(v); ok {
+			return f
+		}
+		return bson.M{bsonTypeField: bsonTypeNumber, bsonValueField: string(v)}
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = toBsonValue(item)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(bson.M, len(v))
+		for key, item := range v {
+			res[key] = toBsonValue(item)
+		}
+		if _, ok := v[bsonTypeField]; ok {
+			return bson.M{bsonTypeField: bsonTypeDict, bsonValueField: res}
+		}
+		return res
+	}
+	return value
+}
+
+// exactFloat converts number to float64 if the shortest form of float has the same decimal value
+func exactFloat(number json.Number) (float64, bool) {
+	f, err := number.Float64()
+	if err != nil {
+		return 0, false
+	}
+	want, ok := new(big.Rat).SetString(string(number))
+	if !ok {
+		return 0, false
+	}
+	got, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return f, ok && want.Cmp(got) == 0
+}
+
+// fromBsonValue restores value converted by toBsonValue. Nested documents become plain maps
+func fromBsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int64:
+		// Native 64-bit integer is int which doesn't fit in 32 bits
+		return int(v), nil
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			decoded, err := fromBsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = decoded
+		}
+		return res, nil
+	case bson.M:
+		return fromBsonDocument(v)
+	case map[string]interface{}:
+		// Documents nested in map are decoded as maps of the same type
+		return fromBsonDocument(v)
+	}
+	return value, nil
+}
+
+// fromBsonDocument restores dict or tagged value
+func fromBsonDocument(document map[string]interface{}) (interface{}, error) {
+	if _, ok := document[bsonTypeField]; ok {
+		vType, _ := document[bsonTypeField].(string)
+		return fromTaggedBsonValue(vType, document[bsonValueField])
+	}
+	return fromBsonDict(document)
+}
+
+// fromTaggedBsonValue restores value stored with type tag
+func fromTaggedBsonValue(vType string, value interface{}) (interface{}, error) {
+	switch vType {
+	case bsonTypeInt64:
+		if i, ok := value.(int64); ok {
+			return i, nil
+		}
+		if i, ok := value.(int); ok {
+			return int64(i), nil
+		}
+	case bsonTypeNumber:
+		if s, ok := value.(string); ok {
+			return json.Number(s), nil
+		}
+	case bsonTypeDict:
+		switch dict := value.(type) {
+		case bson.M:
+			return fromBsonDict(dict)
+		case map[string]interface{}:
+			return fromBsonDict(dict)
+		}
+	}
+	return nil, errors.New("Broken value of type " + vType)
+}
+
+// fromBsonDict restores items of stored dict
+func fromBsonDict(dict map[string]interface{}) (map[string]interface{}, error) {
+	res := make(map[string]interface{}, len(dict))
+	for key, item := range dict {
+		decoded, err := fromBsonValue(item)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = decoded
+	}
+	return res, nil
+}
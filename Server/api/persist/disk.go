@@ -0,0 +1,355 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/Labutin/KVServer/Server/api/persist/diskstore"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// diskTypeEncrypted replaces type code of value encrypted with keyring
+const diskTypeEncrypted = 0xEE
+
+// DiskStorage keeps records in embedded on-disk key-value store. Values are encoded like in binary snapshot
+type DiskStorage struct {
+	// mutex keeps re-encryption from overwriting records written at the same time
+	mutex   sync.Mutex
+	path    string
+	db      *diskstore.DB
+	keyring *Keyring
+}
+
+func init() {
+	RegisterBackend("disk", openDiskURL)
+}
+
+// openDiskURL opens store given as disk:///path/to/file. Values are encrypted with keyring of backend options
+func openDiskURL(rawURL string, options BackendOptions) (PersistStorage, error) {
+	path, _, err := parseFileURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := NewDiskStorage(path)
+	if err != nil {
+		return nil, err
+	}
+	disk.SetKeyring(options.Keyring)
+	return disk, nil
+}
+
+// NewDiskStorage opens (or creates) store file
+func NewDiskStorage(path string) (*DiskStorage, error) {
+	db, err := diskstore.Open(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskStorage{path: path, db: db}, nil
+}
+
+// SetKeyring makes storage encrypt values it writes. Must be called before storage is used
+func (t *DiskStorage) SetKeyring(keyring *Keyring) {
+	t.keyring = keyring
+}
+
+// encodeRecord encodes TTL and value of stored record. Encrypted value is stored with key ID and wrapped data key
+func (t *DiskStorage) encodeRecord(key string, value interface{}, ttl int64) ([]byte, error) {
+	typed := &bytes.Buffer{}
+	w := newSnapshotWriter(typed)
+	w.writeTyped(value)
+	if w.err != nil || t.keyring == nil {
+		return append(encodeTTL(ttl), typed.Bytes()...), w.err
+	}
+	sealed, err := t.keyring.seal(typed.Bytes(), key)
+	if err != nil {
+		return nil, err
+	}
+	return encodeEnvelope(ttl, sealed)
+}
+
+// encodeTTL encodes TTL which starts every record
+func encodeTTL(ttl int64) []byte {
+	buf := &bytes.Buffer{}
+	newSnapshotWriter(buf).writeVarint(ttl)
+	return buf.Bytes()
+}
+
+// encodeEnvelope encodes TTL and encrypted value
+func encodeEnvelope(ttl int64, sealed envelope) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := newSnapshotWriter(buf)
+	w.writeVarint(ttl)
+	w.write([]byte{diskTypeEncrypted})
+	w.writeString(sealed.KeyID)
+	w.writeString(string(sealed.DataKey))
+	w.writeString(string(sealed.Data))
+	return buf.Bytes(), w.err
+}
+
+// splitRecord returns TTL of stored record and either its encrypted value or reader of plain value
+func splitRecord(data []byte) (int64, *envelope, *snapshotReader, error) {
+	r := &snapshotReader{r: bufio.NewReader(bytes.NewReader(data))}
+	ttl := r.readVarint()
+	if r.err != nil {
+		return 0, nil, nil, r.err
+	}
+	if code, err := r.r.Peek(1); err != nil || code[0] != diskTypeEncrypted {
+		return ttl, nil, r, nil
+	}
+	r.readByte()
+	sealed := &envelope{KeyID: r.readString(), DataKey: r.readBytes(), Data: r.readBytes()}
+	return ttl, sealed, nil, r.err
+}
+
+// decodeRecord restores TTL and value of stored record
+func (t *DiskStorage) decodeRecord(key string, data []byte) (interface{}, int64, error) {
+	ttl, sealed, r, err := splitRecord(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sealed != nil {
+		if t.keyring == nil {
+			return nil, 0, errors.New("Record is encrypted, but encryption keys are not configured")
+		}
+		plaintext, err := t.keyring.open(*sealed, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		r = &snapshotReader{r: bufio.NewReader(bytes.NewReader(plaintext))}
+	}
+	value := r.readTyped()
+	return value, ttl, r.err
+}
+
+// SaveToDb atomically replaces content of store with all records
+func (t *DiskStorage) SaveToDb(storage *kvstorage.Storage) error {
+	return t.SaveToDbContext(context.Background(), storage)
+}
+
+// SaveToDbContext is SaveToDb which can be cancelled. Cancelled save keeps previous content
+func (t *DiskStorage) SaveToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	changed, deleted := storage.TakeDirty()
+	err := t.db.Replace(func(put func(string, []byte) error) error {
+		for _, key := range storage.Keys() {
+			if err := keyDone(ctx); err != nil {
+				return err
+			}
+			value, ttl, ok := storage.GetWithTTL(key)
+			if !ok {
+				continue
+			}
+			data, err := t.encodeRecord(key, value, ttl)
+			if err != nil {
+				return err
+			}
+			if err := put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storage.RestoreDirty(changed, deleted)
+	}
+	return err
+}
+
+// SaveChangesToDb writes records changed and deletes records removed since previous save
+func (t *DiskStorage) SaveChangesToDb(storage *kvstorage.Storage) error {
+	return t.SaveChangesToDbContext(context.Background(), storage)
+}
+
+// SaveChangesToDbContext is SaveChangesToDb which can be cancelled before changes are written
+func (t *DiskStorage) SaveChangesToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	changed, deleted := storage.TakeDirty()
+	if err := t.saveKeys(ctx, storage, append(append([]string{}, changed...), deleted...)); err != nil {
+		storage.RestoreDirty(changed, deleted)
+		return err
+	}
+	if t.db.NeedCompaction() {
+		if err := t.db.Compact(); err != nil {
+			log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Can't compact store "+t.path, err))
+		}
+	}
+	log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_ID, "Saved "+strconv.Itoa(len(changed))+" changed and "+strconv.Itoa(len(deleted))+" deleted keys", nil))
+	return nil
+}
+
+// SaveKeys writes current state of keys with one write. Absent keys are deleted
+func (t *DiskStorage) SaveKeys(storage *kvstorage.Storage, keys []string) error {
+	return t.saveKeys(context.Background(), storage, keys)
+}
+
+// saveKeys collects keys to batch until context is cancelled
+func (t *DiskStorage) saveKeys(ctx context.Context, storage *kvstorage.Storage, keys []string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	batch := diskstore.NewBatch()
+	for _, key := range keys {
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
+		value, ttl, ok := storage.GetWithTTL(key)
+		if !ok {
+			batch.Delete(key)
+			continue
+		}
+		data, err := t.encodeRecord(key, value, ttl)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, data)
+	}
+	return t.db.Write(batch)
+}
+
+// LoadKey returns value and TTL of one record
+func (t *DiskStorage) LoadKey(key string) (interface{}, int64, bool, error) {
+	data, ok, err := t.db.Get(key)
+	if err != nil || !ok {
+		return nil, 0, false, err
+	}
+	value, ttl, err := t.decodeRecord(key, data)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return value, ttl, true, nil
+}
+
+// LoadFromDb loads all records which are not expired
+func (t *DiskStorage) LoadFromDb(storage *kvstorage.Storage) error {
+	return t.LoadFromDbContext(context.Background(), storage)
+}
+
+// LoadFromDbContext is LoadFromDb which can be cancelled. Records loaded before cancellation stay in storage
+func (t *DiskStorage) LoadFromDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	currentTime := time.Now().Unix()
+	for _, key := range t.db.Keys() {
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
+		data, ok, err := t.db.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		value, ttl, err := t.decodeRecord(key, data)
+		if err != nil {
+			return errors.New("Broken record with key " + key + ": " + err.Error())
+		}
+		if ttl > 0 && ttl <= currentTime {
+			log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_ID, "Skipped key: "+key, nil))
+			continue
+		}
+		var duration time.Duration
+		if ttl > 0 {
+			duration = time.Unix(ttl, 0).Sub(time.Now())
+		}
+		storage.Set(key, value, duration)
+	}
+	storage.TakeDirty()
+	return nil
+}
+
+// SaveSchemas replaces JSON Schemas stored next to store file
+func (t *DiskStorage) SaveSchemas(schemas map[string]interface{}) error {
+	return saveSchemasFile(t.path+SCHEMAS_FILE_SUFFIX, schemas)
+}
+
+// LoadSchemas returns JSON Schemas stored next to store file
+func (t *DiskStorage) LoadSchemas() (map[string]interface{}, error) {
+	return loadSchemasFile(t.path + SCHEMAS_FILE_SUFFIX)
+}
+
+// Encrypted reports whether values are encrypted
+func (t *DiskStorage) Encrypted() bool {
+	return t.keyring != nil
+}
+
+// Reencrypt encrypts plain records and wraps data keys of records encrypted with old keys with current key.
+// Records are rewritten in batches, so cancelled re-encryption keeps rewritten ones. Returns number of rewritten records
+func (t *DiskStorage) Reencrypt(ctx context.Context) (int, error) {
+	if t.keyring == nil {
+		return 0, errors.New("Encryption keys are not configured")
+	}
+	keys := t.db.Keys()
+	rewritten := 0
+	for start := 0; start < len(keys); start += BULK_SIZE {
+		end := start + BULK_SIZE
+		if end > len(keys) {
+			end = len(keys)
+		}
+		count, err := t.reencryptKeys(ctx, keys[start:end])
+		rewritten += count
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+// reencryptKeys rewrites records not encrypted with current key with one write
+func (t *DiskStorage) reencryptKeys(ctx context.Context, keys []string) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	batch := diskstore.NewBatch()
+	for _, key := range keys {
+		if err := keyDone(ctx); err != nil {
+			return 0, err
+		}
+		data, ok, err := t.db.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		data, err = t.reencryptRecord(key, data)
+		if err != nil {
+			log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Skipped broken record with key: "+key, err))
+			continue
+		}
+		if data != nil {
+			batch.Put(key, data)
+		}
+	}
+	return batch.Len(), t.db.Write(batch)
+}
+
+// reencryptRecord returns record encrypted with current key or nil if record doesn't change
+func (t *DiskStorage) reencryptRecord(key string, data []byte) ([]byte, error) {
+	ttl, sealed, _, err := splitRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	if sealed == nil {
+		value, ttl, err := t.decodeRecord(key, data)
+		if err != nil {
+			return nil, err
+		}
+		return t.encodeRecord(key, value, ttl)
+	}
+	if sealed.KeyID == t.keyring.CurrentID() {
+		return nil, nil
+	}
+	rewrapped, err := t.keyring.rewrap(*sealed)
+	if err != nil {
+		return nil, err
+	}
+	return encodeEnvelope(ttl, rewrapped)
+}
+
+// Close closes store file
+func (t *DiskStorage) Close() error {
+	return t.db.Close()
+}
@@ -0,0 +1,108 @@
+package persist
+
+import (
+	"context"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDiskStorage(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	disk, err := NewDiskStorage(path)
+	require.NoError(t, err)
+	storage := kvstorage.NewKVStorage(4, false)
+	storage.Set("removed", "value", 0)
+	require.NoError(t, disk.SaveToDb(storage))
+	fillStorage(t, storage)
+	require.NoError(t, disk.SaveChangesToDb(storage))
+	storage.Set("after", "save", 0)
+	require.NoError(t, disk.SaveKeys(storage, []string{"after"}))
+	require.NoError(t, disk.Close())
+
+	disk, err = NewDiskStorage(path)
+	require.NoError(t, err)
+	defer disk.Close()
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, disk.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+	value, _ := loaded.Get("after")
+	require.Equal(t, "save", value)
+}
+
+func TestDiskStorageContext(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	disk, err := NewDiskStorage(path)
+	require.NoError(t, err)
+	defer disk.Close()
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	ctx, progress := WithProgress(context.Background())
+	require.NoError(t, disk.SaveToDbContext(ctx, storage))
+	require.Equal(t, int64(len(storage.Keys())), progress.Processed())
+
+	storage.Set("cancelled", "value", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, disk.SaveToDbContext(ctx, storage))
+	require.Equal(t, context.Canceled, disk.SaveChangesToDbContext(ctx, storage))
+	require.Equal(t, 1, storage.DirtyCount())
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.Equal(t, context.Canceled, disk.LoadFromDbContext(ctx, loaded))
+	require.NoError(t, disk.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+	_, ok := loaded.Get("cancelled")
+	require.False(t, ok)
+}
+
+func TestDiskEncryption(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	disk, err := NewDiskStorage(path)
+	require.NoError(t, err)
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	storage.Set("plain", "value", 0)
+	require.NoError(t, disk.SaveKeys(storage, []string{"plain"}))
+	keyring, err := NewKeyring("k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	disk.SetKeyring(keyring)
+	require.NoError(t, disk.SaveToDb(storage))
+	data, ok, err := disk.db.Get("plain")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NotContains(t, string(data), "value")
+	require.NoError(t, disk.Close())
+
+	// Values are still readable after key rotation and are re-encrypted with new key
+	disk, err = NewDiskStorage(path)
+	require.NoError(t, err)
+	defer disk.Close()
+	rotated, err := NewKeyring("k2:" + testKey(2, 32) + ",k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	disk.SetKeyring(rotated)
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, disk.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+	count, err := disk.Reencrypt(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(storage.Keys()), count)
+	count, err = disk.Reencrypt(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	disk.SetKeyring(nil)
+	_, _, _, err = disk.LoadKey("plain")
+	require.Error(t, err)
+	// Load fails instead of dropping records which can't be decrypted
+	require.Error(t, disk.LoadFromDb(kvstorage.NewKVStorage(4, false)))
+	newKeys, err := NewKeyring("k2:" + testKey(2, 32))
+	require.NoError(t, err)
+	disk.SetKeyring(newKeys)
+	value, _, ok, err := disk.LoadKey("plain")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "value", value)
+}
@@ -0,0 +1,411 @@
+package diskstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Record is CRC-32 of the rest of record, operation, key length, value length, key and value
+const (
+	opPut    = 1
+	opDelete = 2
+)
+
+const (
+	TMP_SUFFIX = ".tmp"
+	// Compaction is worth running when stale records take more than half of file and at least MIN_COMPACT_SIZE
+	MIN_COMPACT_SIZE = 16 * 1024 * 1024
+)
+
+var ErrClosed = errors.New("Store is closed")
+
+// location of value in file
+type location struct {
+	offset int64
+	length int
+	record int64
+}
+
+// DB is embedded key-value store. Every change is appended to single file, index of keys is kept in memory
+type DB struct {
+	sync.RWMutex
+	path    string
+	file    *os.File
+	index   map[string]location
+	size    int64
+	garbage int64
+	noSync  bool
+}
+
+// Batch is set of changes written with one write and one fsync
+type Batch struct {
+	puts    map[string][]byte
+	deletes map[string]bool
+}
+
+// NewBatch creates empty batch
+func NewBatch() *Batch {
+	return &Batch{puts: map[string][]byte{}, deletes: map[string]bool{}}
+}
+
+// Put adds value of key to batch
+func (t *Batch) Put(key string, value []byte) {
+	delete(t.deletes, key)
+	t.puts[key] = value
+}
+
+// Delete adds deletion of key to batch
+func (t *Batch) Delete(key string) {
+	delete(t.puts, key)
+	t.deletes[key] = true
+}
+
+// Len returns number of changes in batch
+func (t *Batch) Len() int {
+	return len(t.puts) + len(t.deletes)
+}
+
+// Open opens (or creates) store file and builds index. Broken tail of file (e.g. after crash) is cut off,
+// broken record followed by other data is an error. If noSync is true changes are not flushed to disk
+func Open(path string, noSync bool) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{path: path, file: file, index: map[string]location{}, noSync: noSync}
+	if err := db.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads all records and builds index
+func (t *DB) load() error {
+	reader := bufio.NewReader(io.NewSectionReader(t.file, 0, 1<<62))
+	var offset int64
+	for {
+		op, key, value, n, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Incomplete or broken last record is the result of interrupted write. Records after broken one
+			// would be lost if it were cut off
+			tail, tailErr := t.isTail(err, offset, offset+int64(n))
+			if tailErr != nil {
+				return tailErr
+			}
+			if !tail {
+				return errors.New("Broken record at offset " + strconv.FormatInt(offset, 10) + ": " + err.Error())
+			}
+			if err := t.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		t.apply(op, key, offset+int64(n-len(value)), len(value), int64(n))
+		offset += int64(n)
+	}
+	t.size = offset
+	return nil
+}
+
+// isTail reports whether broken record at offset (ending at end if its length is known) is the result
+// of interrupted write: it is incomplete or only zeros (e.g. written by file system after crash) follow it
+func (t *DB) isTail(err error, offset, end int64) (bool, error) {
+	if err == io.ErrUnexpectedEOF {
+		return true, nil
+	}
+	info, statErr := t.file.Stat()
+	if statErr != nil {
+		return false, statErr
+	}
+	if end < offset {
+		end = offset
+	}
+	if end >= info.Size() {
+		return true, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(t.file, end, info.Size()-end))
+	for {
+		b, readErr := reader.ReadByte()
+		if readErr == io.EOF {
+			return true, nil
+		}
+		if readErr != nil {
+			return false, readErr
+		}
+		if b != 0 {
+			return false, nil
+		}
+	}
+}
+
+// apply updates index with record at offset
+func (t *DB) apply(op byte, key string, valueOffset int64, valueLength int, recordLength int64) {
+	if old, ok := t.index[key]; ok {
+		t.garbage += old.record
+	}
+	if op == opDelete {
+		delete(t.index, key)
+		t.garbage += recordLength
+		return
+	}
+	t.index[key] = location{offset: valueOffset, length: valueLength, record: recordLength}
+}
+
+// encodeRecord appends record to buffer
+func encodeRecord(buf []byte, op byte, key string, value []byte) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, op)
+	var varint [binary.MaxVarintLen64]byte
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(key)))]...)
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(value)))]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	binary.BigEndian.PutUint32(buf[start:], crc32.ChecksumIEEE(buf[start+4:]))
+	return buf
+}
+
+// readRecord reads one record. Returns its operation, key, value and length. Length of record with wrong
+// checksum is returned too
+func readRecord(reader *bufio.Reader) (byte, string, []byte, int, error) {
+	header := make([]byte, 5, 5+2*binary.MaxVarintLen64)
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return 0, "", nil, 0, err
+	}
+	if _, err := io.ReadFull(reader, header[1:]); err != nil {
+		return 0, "", nil, 0, io.ErrUnexpectedEOF
+	}
+	op := header[4]
+	if op != opPut && op != opDelete {
+		return 0, "", nil, 0, errors.New("Unknown operation")
+	}
+	lengths := [2]uint64{}
+	for i := range lengths {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, "", nil, 0, io.ErrUnexpectedEOF
+		}
+		lengths[i] = length
+		var varint [binary.MaxVarintLen64]byte
+		header = append(header, varint[:binary.PutUvarint(varint[:], length)]...)
+	}
+	data := make([]byte, lengths[0]+lengths[1])
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, "", nil, 0, io.ErrUnexpectedEOF
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	if crc.Sum32() != binary.BigEndian.Uint32(header) {
+		return 0, "", nil, len(header) + len(data), errors.New("Checksum mismatch")
+	}
+	return op, string(data[:lengths[0]]), data[lengths[0]:], len(header) + len(data), nil
+}
+
+// Get returns value of key
+func (t *DB) Get(key string) ([]byte, bool, error) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.file == nil {
+		return nil, false, ErrClosed
+	}
+	location, ok := t.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	value := make([]byte, location.length)
+	if _, err := t.file.ReadAt(value, location.offset); err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Keys returns all keys in sorted order
+func (t *DB) Keys() []string {
+	t.RLock()
+	defer t.RUnlock()
+	keys := make([]string, 0, len(t.index))
+	for key := range t.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len returns number of keys
+func (t *DB) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.index)
+}
+
+// Put stores value of key
+func (t *DB) Put(key string, value []byte) error {
+	batch := NewBatch()
+	batch.Put(key, value)
+	return t.Write(batch)
+}
+
+// Delete removes key
+func (t *DB) Delete(key string) error {
+	batch := NewBatch()
+	batch.Delete(key)
+	return t.Write(batch)
+}
+
+// Write appends all changes of batch to file and flushes it to disk
+func (t *DB) Write(batch *Batch) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return ErrClosed
+	}
+	type change struct {
+		op     byte
+		key    string
+		length int
+		end    int
+	}
+	buf := []byte{}
+	changes := make([]change, 0, batch.Len())
+	for key, value := range batch.puts {
+		buf = encodeRecord(buf, opPut, key, value)
+		changes = append(changes, change{opPut, key, len(value), len(buf)})
+	}
+	for key := range batch.deletes {
+		if _, ok := t.index[key]; !ok {
+			continue
+		}
+		buf = encodeRecord(buf, opDelete, key, nil)
+		changes = append(changes, change{opDelete, key, 0, len(buf)})
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := t.file.Write(buf); err != nil {
+		// Remove partially written records, otherwise they are cut off on next open
+		t.file.Truncate(t.size)
+		return err
+	}
+	if !t.noSync {
+		if err := t.file.Sync(); err != nil {
+			// Records which may be not on disk are removed, so that file ends where index expects
+			t.file.Truncate(t.size)
+			return err
+		}
+	}
+	start := 0
+	for _, change := range changes {
+		t.apply(change.op, change.key, t.size+int64(change.end-change.length), change.length, int64(change.end-start))
+		start = change.end
+	}
+	t.size += int64(len(buf))
+	return nil
+}
+
+// Replace atomically replaces content of store with records produced by fill
+func (t *DB) Replace(fill func(put func(key string, value []byte) error) error) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return ErrClosed
+	}
+	return t.replace(fill)
+}
+
+// Compact rewrites file without stale records
+func (t *DB) Compact() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return ErrClosed
+	}
+	return t.replace(func(put func(key string, value []byte) error) error {
+		for key, location := range t.index {
+			value := make([]byte, location.length)
+			if _, err := t.file.ReadAt(value, location.offset); err != nil {
+				return err
+			}
+			if err := put(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NeedCompaction reports whether stale records take too much space
+func (t *DB) NeedCompaction() bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.size >= MIN_COMPACT_SIZE && t.garbage*2 > t.size
+}
+
+// replace writes new file with records produced by fill and renames it over current one
+func (t *DB) replace(fill func(put func(key string, value []byte) error) error) error {
+	tmpPath := t.path + TMP_SUFFIX
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	index := map[string]location{}
+	var size int64
+	buf := []byte{}
+	err = fill(func(key string, value []byte) error {
+		buf = encodeRecord(buf[:0], opPut, key, value)
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+		size += int64(len(buf))
+		index[key] = location{offset: size - int64(len(value)), length: len(value), record: int64(len(buf))}
+		return nil
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, t.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(t.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	t.file.Close()
+	t.file = tmp
+	t.index = index
+	t.size = size
+	t.garbage = 0
+	return nil
+}
+
+// Close closes store file
+func (t *DB) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
@@ -0,0 +1,121 @@
+package diskstore
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) (*DB, string, func()) {
+	dir, err := ioutil.TempDir("", "diskstore")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "data.db")
+	db, err := Open(path, false)
+	require.NoError(t, err)
+	return db, path, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	db, path, cleanup := openTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.Put("a", []byte("1")))
+	require.NoError(t, db.Put("b", []byte("2")))
+	require.NoError(t, db.Put("a", []byte("3")))
+	require.NoError(t, db.Delete("b"))
+	require.NoError(t, db.Delete("absent"))
+	batch := NewBatch()
+	batch.Put("c", []byte("4"))
+	batch.Put("d", []byte{})
+	batch.Delete("d")
+	require.NoError(t, db.Write(batch))
+
+	check := func(db *DB) {
+		value, ok, err := db.Get("a")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte("3"), value)
+		_, ok, err = db.Get("b")
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Equal(t, []string{"a", "c"}, db.Keys())
+	}
+	check(db)
+	require.NoError(t, db.Close())
+	_, _, err := db.Get("a")
+	require.Equal(t, ErrClosed, err)
+
+	db, err = Open(path, false)
+	require.NoError(t, err)
+	defer db.Close()
+	check(db)
+	require.NoError(t, db.Compact())
+	check(db)
+}
+
+func TestBrokenTail(t *testing.T) {
+	db, path, cleanup := openTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.Put("a", []byte("1")))
+	require.NoError(t, db.Put("b", []byte("2")))
+	require.NoError(t, db.Close())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-1))
+
+	db, err = Open(path, false)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, []string{"a"}, db.Keys())
+	require.NoError(t, db.Put("c", []byte("3")))
+	value, _, err := db.Get("c")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+}
+
+func TestBrokenRecord(t *testing.T) {
+	db, path, cleanup := openTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.Put("a", []byte("1")))
+	require.NoError(t, db.Put("b", []byte("2")))
+	require.NoError(t, db.Put("c", []byte("3")))
+	require.NoError(t, db.Close())
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	// Broken record followed by other records is not cut off
+	broken := append([]byte{}, raw...)
+	broken[len(broken)/3-1] ^= 0xFF
+	require.NoError(t, ioutil.WriteFile(path, broken, 0644))
+	_, err = Open(path, false)
+	require.Error(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(raw)), info.Size())
+
+	// Broken last record and zeroed tail are the result of interrupted write
+	broken = append([]byte{}, raw...)
+	broken[len(broken)-1] ^= 0xFF
+	broken = append(broken, 0, 0, 0, 0, 0, 0, 0, 0)
+	require.NoError(t, ioutil.WriteFile(path, broken, 0644))
+	db, err = Open(path, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, db.Keys())
+}
+
+func TestReplace(t *testing.T) {
+	db, _, cleanup := openTestDB(t)
+	defer cleanup()
+	require.NoError(t, db.Put("a", []byte("1")))
+	require.NoError(t, db.Replace(func(put func(string, []byte) error) error {
+		return put("b", []byte("2"))
+	}))
+	require.Equal(t, []string{"b"}, db.Keys())
+	value, _, err := db.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+}
@@ -0,0 +1,177 @@
+package persist
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// DATA_KEY_SIZE is size of AES-256 key generated for every encrypted value
+const DATA_KEY_SIZE = 32
+
+// Keyring keeps master keys by ID. Every value is encrypted with its own data key, which is encrypted
+// (wrapped) with current master key. ID of master key is stored next to value, so old keys can still
+// decrypt values until they are re-encrypted
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// envelope is encrypted value with its wrapped data key
+type envelope struct {
+	KeyID   string `bson:"kid" json:"kid"`
+	DataKey []byte `bson:"dek" json:"dek"`
+	Data    []byte `bson:"data" json:"data"`
+}
+
+// Reencrypter is persistent storage which encrypts values and can re-encrypt them with current master key
+type Reencrypter interface {
+	Encrypted() bool
+	Reencrypt(ctx context.Context) (int, error)
+}
+
+// NewKeyring parses master keys given as "id:base64 key" separated by commas or new lines.
+// Keys must be 16, 24 or 32 bytes long. The first key is current, others only decrypt
+func NewKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Encryption key must be given as id:key")
+		}
+		id := parts[0]
+		if _, ok := keyring.keys[id]; ok {
+			return nil, errors.New("Duplicate encryption key: " + id)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.New("Encryption key " + id + " is not base64: " + err.Error())
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.New("Encryption key " + id + ": " + err.Error())
+		}
+		keyring.keys[id] = aead
+		if keyring.current == "" {
+			keyring.current = id
+		}
+	}
+	if keyring.current == "" {
+		return nil, errors.New("No encryption keys")
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads master keys from file in format of NewKeyring
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(string(data))
+}
+
+// CurrentID returns ID of key which encrypts new values
+func (t *Keyring) CurrentID() string {
+	return t.current
+}
+
+// newAEAD returns AES-GCM cipher
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt prepends random nonce to ciphertext
+func encrypt(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// decrypt reads nonce prepended to ciphertext
+func decrypt(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Encrypted data is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additional)
+}
+
+// seal encrypts value of record with new data key. Record key is authenticated with value, so encrypted
+// value can't be moved to other record
+func (t *Keyring) seal(plaintext []byte, recordKey string) (envelope, error) {
+	dataKey := make([]byte, DATA_KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
+		return envelope{}, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return envelope{}, err
+	}
+	data, err := encrypt(aead, plaintext, []byte(recordKey))
+	if err != nil {
+		return envelope{}, err
+	}
+	wrapped, err := encrypt(t.keys[t.current], dataKey, []byte(t.current))
+	if err != nil {
+		return envelope{}, err
+	}
+	return envelope{KeyID: t.current, DataKey: wrapped, Data: data}, nil
+}
+
+// unwrap decrypts data key of envelope
+func (t *Keyring) unwrap(value envelope) ([]byte, error) {
+	master, ok := t.keys[value.KeyID]
+	if !ok {
+		return nil, errors.New("Unknown encryption key: " + value.KeyID)
+	}
+	dataKey, err := decrypt(master, value.DataKey, []byte(value.KeyID))
+	if err != nil {
+		return nil, errors.New("Can't decrypt data key: " + err.Error())
+	}
+	return dataKey, nil
+}
+
+// open decrypts value of record
+func (t *Keyring) open(value envelope, recordKey string) ([]byte, error) {
+	dataKey, err := t.unwrap(value)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(aead, value.Data, []byte(recordKey))
+	if err != nil {
+		return nil, errors.New("Can't decrypt value: " + err.Error())
+	}
+	return plaintext, nil
+}
+
+// rewrap encrypts data key of envelope with current master key. Value itself is not decrypted
+func (t *Keyring) rewrap(value envelope) (envelope, error) {
+	dataKey, err := t.unwrap(value)
+	if err != nil {
+		return envelope{}, err
+	}
+	wrapped, err := encrypt(t.keys[t.current], dataKey, []byte(t.current))
+	if err != nil {
+		return envelope{}, err
+	}
+	return envelope{KeyID: t.current, DataKey: wrapped, Data: value.Data}, nil
+}
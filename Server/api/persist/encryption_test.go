@@ -0,0 +1,73 @@
+package persist
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testKey returns base64 key of given size filled with given byte
+func testKey(b byte, size int) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string([]byte{b}), size)))
+}
+
+func TestNewKeyring(t *testing.T) {
+	keyring, err := NewKeyring("# rotated\nnew:" + testKey(1, 32) + "\n\nold:" + testKey(2, 16))
+	require.NoError(t, err)
+	require.Equal(t, "new", keyring.CurrentID())
+	require.Len(t, keyring.keys, 2)
+	keyring, err = NewKeyring("a:" + testKey(1, 24) + ",b:" + testKey(2, 32))
+	require.NoError(t, err)
+	require.Equal(t, "a", keyring.CurrentID())
+
+	for _, spec := range []string{"", "# only comment", "nokey", ":" + testKey(1, 32), "a:" + testKey(1, 20),
+		"a:not base64", "a:" + testKey(1, 32) + ",a:" + testKey(2, 32)} {
+		_, err := NewKeyring(spec)
+		require.Error(t, err, spec)
+	}
+
+	file, err := ioutil.TempFile("", "keys")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("file:" + testKey(3, 32) + "\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	keyring, err = LoadKeyring(file.Name())
+	require.NoError(t, err)
+	require.Equal(t, "file", keyring.CurrentID())
+}
+
+func TestKeyringSeal(t *testing.T) {
+	old, err := NewKeyring("old:" + testKey(1, 32))
+	require.NoError(t, err)
+	sealed, err := old.seal([]byte("secret"), "token")
+	require.NoError(t, err)
+	require.Equal(t, "old", sealed.KeyID)
+	require.NotContains(t, string(sealed.Data), "secret")
+	plaintext, err := old.open(sealed, "token")
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(plaintext))
+	// Value moved to other record is not decrypted
+	_, err = old.open(sealed, "other")
+	require.Error(t, err)
+
+	rotated, err := NewKeyring("new:" + testKey(2, 32) + ",old:" + testKey(1, 32))
+	require.NoError(t, err)
+	rewrapped, err := rotated.rewrap(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "new", rewrapped.KeyID)
+	require.Equal(t, sealed.Data, rewrapped.Data)
+	plaintext, err = rotated.open(rewrapped, "token")
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(plaintext))
+
+	// Old key can't decrypt rewrapped value and modified data key is rejected
+	_, err = old.open(rewrapped, "token")
+	require.Error(t, err)
+	rewrapped.DataKey[len(rewrapped.DataKey)-1] ^= 1
+	_, err = rotated.open(rewrapped, "token")
+	require.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	SCHEMAS_FILE_SUFFIX = ".schemas"
+	TMP_FILE_SUFFIX     = ".tmp"
+)
+
+// writeFileAtomic writes file to temporary file, flushes it to disk and renames it over path.
+// Failed write never destroys previous file
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmpPath := path + TMP_FILE_SUFFIX
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes directory entry changes (e.g. rename) to disk
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// saveSchemasFile replaces JSON Schemas stored in file
+func saveSchemasFile(path string, schemas map[string]interface{}) error {
+	return writeFileAtomic(path, func(writer io.Writer) error {
+		return json.NewEncoder(writer).Encode(schemas)
+	})
+}
+
+// loadSchemasFile returns JSON Schemas stored in file. Absent file means no schemas
+func loadSchemasFile(path string) (map[string]interface{}, error) {
+	schemas := map[string]interface{}{}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return schemas, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &schemas); err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
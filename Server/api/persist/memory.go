@@ -0,0 +1,228 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// memoryStorages are named memory storages shared by all URLs with the same name
+var memoryStorages = struct {
+	sync.Mutex
+	byName map[string]*MemoryStorage
+}{byName: map[string]*MemoryStorage{}}
+
+// MemoryStorage keeps records in memory of process. Values are encoded like in binary snapshot, so stored
+// records don't share data with storage. It is fake of persistent storage for tests
+type MemoryStorage struct {
+	sync.Mutex
+	records map[string]memoryRecord
+	schemas map[string]interface{}
+}
+
+// memoryRecord is encoded value and TTL (unix time, 0 means no TTL)
+type memoryRecord struct {
+	value []byte
+	ttl   int64
+}
+
+func init() {
+	RegisterBackend("memory", openMemoryURL)
+}
+
+// openMemoryURL creates memory storage. Storage given as memory://name is shared by all URLs with this name,
+// memory:// is new storage every time
+func openMemoryURL(rawURL string, options BackendOptions) (PersistStorage, error) {
+	if err := options.unencrypted(rawURL); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return NewMemoryStorage(), nil
+	}
+	memoryStorages.Lock()
+	defer memoryStorages.Unlock()
+	memoryStorage, ok := memoryStorages.byName[u.Host]
+	if !ok {
+		memoryStorage = NewMemoryStorage()
+		memoryStorages.byName[u.Host] = memoryStorage
+	}
+	return memoryStorage, nil
+}
+
+// NewMemoryStorage creates empty memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{records: map[string]memoryRecord{}, schemas: map[string]interface{}{}}
+}
+
+// SaveToDb replaces all records with keys of storage
+func (t *MemoryStorage) SaveToDb(storage *kvstorage.Storage) error {
+	return t.SaveToDbContext(context.Background(), storage)
+}
+
+// SaveToDbContext is SaveToDb which can be cancelled. Cancelled save keeps previous records
+func (t *MemoryStorage) SaveToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	changed, deleted := storage.TakeDirty()
+	records := map[string]memoryRecord{}
+	for _, key := range storage.Keys() {
+		if err := keyDone(ctx); err != nil {
+			storage.RestoreDirty(changed, deleted)
+			return err
+		}
+		value, ttl, ok := storage.GetWithTTL(key)
+		if !ok {
+			continue
+		}
+		record, err := newMemoryRecord(value, ttl)
+		if err != nil {
+			storage.RestoreDirty(changed, deleted)
+			return err
+		}
+		records[key] = record
+	}
+	t.Lock()
+	t.records = records
+	t.Unlock()
+	return nil
+}
+
+// SaveChangesToDb saves keys changed and deleted since previous save
+func (t *MemoryStorage) SaveChangesToDb(storage *kvstorage.Storage) error {
+	return t.SaveChangesToDbContext(context.Background(), storage)
+}
+
+// SaveChangesToDbContext is SaveChangesToDb which can be cancelled. Keys which are not saved stay changed
+func (t *MemoryStorage) SaveChangesToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	changed, deleted := storage.TakeDirty()
+	if err := t.saveKeys(ctx, storage, append(append([]string{}, changed...), deleted...)); err != nil {
+		storage.RestoreDirty(changed, deleted)
+		return err
+	}
+	return nil
+}
+
+// SaveKeys saves current state of keys. Absent keys are deleted
+func (t *MemoryStorage) SaveKeys(storage *kvstorage.Storage, keys []string) error {
+	return t.saveKeys(context.Background(), storage, keys)
+}
+
+// saveKeys saves keys until context is cancelled
+func (t *MemoryStorage) saveKeys(ctx context.Context, storage *kvstorage.Storage, keys []string) error {
+	for _, key := range keys {
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
+		value, ttl, ok := storage.GetWithTTL(key)
+		if !ok {
+			t.Lock()
+			delete(t.records, key)
+			t.Unlock()
+			continue
+		}
+		record, err := newMemoryRecord(value, ttl)
+		if err != nil {
+			return err
+		}
+		t.Lock()
+		t.records[key] = record
+		t.Unlock()
+	}
+	return nil
+}
+
+// LoadKey returns value and TTL of one record
+func (t *MemoryStorage) LoadKey(key string) (interface{}, int64, bool, error) {
+	t.Lock()
+	record, ok := t.records[key]
+	t.Unlock()
+	if !ok {
+		return nil, 0, false, nil
+	}
+	value, err := record.decode()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return value, record.ttl, true, nil
+}
+
+// LoadFromDb loads all records which are not expired
+func (t *MemoryStorage) LoadFromDb(storage *kvstorage.Storage) error {
+	return t.LoadFromDbContext(context.Background(), storage)
+}
+
+// LoadFromDbContext is LoadFromDb which can be cancelled. Records loaded before cancellation stay in storage
+func (t *MemoryStorage) LoadFromDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	t.Lock()
+	records := make(map[string]memoryRecord, len(t.records))
+	for key, record := range t.records {
+		records[key] = record
+	}
+	t.Unlock()
+	currentTime := time.Now().Unix()
+	for key, record := range records {
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
+		if record.ttl > 0 && record.ttl <= currentTime {
+			continue
+		}
+		value, err := record.decode()
+		if err != nil {
+			return err
+		}
+		var duration time.Duration
+		if record.ttl > 0 {
+			duration = time.Unix(record.ttl, 0).Sub(time.Now())
+		}
+		storage.Set(key, value, duration)
+	}
+	storage.TakeDirty()
+	return nil
+}
+
+// SaveSchemas replaces stored JSON Schemas
+func (t *MemoryStorage) SaveSchemas(schemas map[string]interface{}) error {
+	t.Lock()
+	defer t.Unlock()
+	t.schemas = make(map[string]interface{}, len(schemas))
+	for prefix, schema := range schemas {
+		t.schemas[prefix] = schema
+	}
+	return nil
+}
+
+// LoadSchemas returns stored JSON Schemas by key prefix
+func (t *MemoryStorage) LoadSchemas() (map[string]interface{}, error) {
+	t.Lock()
+	defer t.Unlock()
+	schemas := make(map[string]interface{}, len(t.schemas))
+	for prefix, schema := range t.schemas {
+		schemas[prefix] = schema
+	}
+	return schemas, nil
+}
+
+// newMemoryRecord encodes value of storage
+func newMemoryRecord(value interface{}, ttl int64) (memoryRecord, error) {
+	buf := &bytes.Buffer{}
+	w := newSnapshotWriter(buf)
+	w.writeTyped(value)
+	if w.err != nil {
+		return memoryRecord{}, w.err
+	}
+	return memoryRecord{value: buf.Bytes(), ttl: ttl}, nil
+}
+
+// decode returns new copy of stored value
+func (t memoryRecord) decode() (interface{}, error) {
+	r := &snapshotReader{r: bufio.NewReader(bytes.NewReader(t.value))}
+	value := r.readTyped()
+	return value, r.err
+}
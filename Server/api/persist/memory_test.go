@@ -0,0 +1,60 @@
+package persist
+
+import (
+	"context"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	persistStorage, err := OpenURL("memory://test", BackendOptions{})
+	require.NoError(t, err)
+	memoryStorage := persistStorage.(*MemoryStorage)
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	require.NoError(t, memoryStorage.SaveToDb(storage))
+	require.Equal(t, 0, storage.DirtyCount())
+
+	// Stored value doesn't change with storage
+	list, _ := storage.Get("list")
+	list.([]interface{})[0] = 2.0
+	storage.Set("after", "save", 0)
+	storage.Set("general", "changed", 0)
+	require.NoError(t, storage.Remove("general"))
+	require.NoError(t, memoryStorage.SaveChangesToDb(storage))
+
+	shared, err := OpenURL("memory://test", BackendOptions{})
+	require.NoError(t, err)
+	require.True(t, shared == persistStorage)
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, shared.LoadFromDb(loaded))
+	_, ok := loaded.Get("general")
+	require.False(t, ok)
+	loaded.Set("general", "value", 0)
+	checkStorage(t, loaded)
+	value, ttl, ok, err := memoryStorage.LoadKey("after")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "save", value)
+	require.Equal(t, int64(0), ttl)
+
+	storage.Set("cancelled", "value", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, memoryStorage.SaveToDbContext(ctx, storage))
+	require.Equal(t, 1, storage.DirtyCount())
+	_, _, ok, err = memoryStorage.LoadKey("cancelled")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	schemas := map[string]interface{}{"user:": map[string]interface{}{"type": "object"}}
+	require.NoError(t, memoryStorage.SaveSchemas(schemas))
+	loadedSchemas, err := memoryStorage.LoadSchemas()
+	require.NoError(t, err)
+	require.Equal(t, schemas, loadedSchemas)
+
+	other, err := OpenURL("memory://", BackendOptions{})
+	require.NoError(t, err)
+	require.False(t, other == persistStorage)
+}
@@ -0,0 +1,177 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+)
+
+// storedValue is stored value which is compressed or encrypted as BSON document
+type storedValue struct {
+	Value interface{} `bson:"value"`
+}
+
+// document converts record of storage chunk to MongoDB document. Value not smaller than compression threshold
+// is compressed, with keyring value is encrypted. Compressed or encrypted value is kept in data field,
+// while key, type, TTL and shard stay readable
+func (t MongoStorage) document(key string, value interface{}, ttl int64, shard int) (map[string]interface{}, error) {
+	document := toDocument(key, value, ttl)
+	document[SHARD_FIELD] = shard
+	if t.options.Keyring == nil && t.options.Compressor == nil {
+		return document, nil
+	}
+	payload, err := bson.Marshal(storedValue{Value: document["value"]})
+	if err != nil {
+		return nil, err
+	}
+	payload, compressed := t.options.Compressor.Compress(payload)
+	if t.options.Keyring == nil && !compressed {
+		return document, nil
+	}
+	delete(document, "value")
+	if compressed {
+		document["z"] = true
+	}
+	if t.options.Keyring == nil {
+		document["data"] = payload
+		return document, nil
+	}
+	sealed, err := t.options.Keyring.seal(payload, key)
+	if err != nil {
+		return nil, err
+	}
+	document["kid"] = sealed.KeyID
+	document["dek"] = sealed.DataKey
+	document["data"] = sealed.Data
+	return document, nil
+}
+
+// unpack restores stored value of compressed or encrypted item
+func (t MongoStorage) unpack(item *mongoItem) error {
+	if item.Envelope.Data == nil {
+		return nil
+	}
+	payload := item.Envelope.Data
+	if item.Envelope.KeyID != "" {
+		if t.options.Keyring == nil {
+			return errors.New("Record is encrypted, but encryption keys are not configured")
+		}
+		var err error
+		if payload, err = t.options.Keyring.open(item.Envelope, item.Key); err != nil {
+			return err
+		}
+	}
+	if item.Compressed {
+		var err error
+		if payload, err = t.options.Compressor.Decompress(payload); err != nil {
+			return err
+		}
+	}
+	stored := storedValue{}
+	if err := bson.Unmarshal(payload, &stored); err != nil {
+		return err
+	}
+	item.Value = stored.Value
+	return nil
+}
+
+// CompressionStats returns totals of compressed documents and whether documents are compressed
+func (t MongoStorage) CompressionStats() (kvstorage.CompressionStats, bool) {
+	if t.options.Compressor == nil {
+		return kvstorage.CompressionStats{}, false
+	}
+	return t.options.Compressor.Stats(), true
+}
+
+// Encrypted reports whether values are encrypted
+func (t MongoStorage) Encrypted() bool {
+	return t.options.Keyring != nil
+}
+
+// Reencrypt encrypts plain records and wraps data keys of records encrypted with old keys with current key.
+// Values encrypted with old keys are not decrypted. Records are updated only if they were not rewritten
+// since they were read. Returns number of updated records
+func (t MongoStorage) Reencrypt(ctx context.Context) (int, error) {
+	if t.options.Keyring == nil {
+		return 0, errors.New("Encryption keys are not configured")
+	}
+	updated := 0
+	err := t.withRetry(ctx, func(session *mgo.Session) error {
+		updated = 0
+		c := session.DB(t.dbName).C(t.collection)
+		// Updated records don't match manifest of saved snapshot anymore
+		if err := t.removeManifest(session, t.collection); err != nil {
+			return err
+		}
+		iter := c.Find(bson.M{"kid": bson.M{"$ne": t.options.Keyring.CurrentID()}}).Iter()
+		item := mongoItem{}
+		count := 0
+		bulk := c.Bulk()
+		bulk.Unordered()
+		for iter.Next(&item) {
+			if err := keyDone(ctx); err != nil {
+				iter.Close()
+				return err
+			}
+			selector, update, err := t.reencryptItem(item)
+			if err != nil {
+				log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Skipped broken record with key: "+item.Key, err))
+				continue
+			}
+			bulk.Update(selector, update)
+			count++
+			if count == t.options.BulkSize {
+				result, err := bulk.Run()
+				if err != nil {
+					iter.Close()
+					return err
+				}
+				updated += result.Matched
+				count = 0
+				bulk = c.Bulk()
+				bulk.Unordered()
+			}
+		}
+		if count > 0 {
+			result, err := bulk.Run()
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			updated += result.Matched
+		}
+		return iter.Close()
+	})
+	return updated, err
+}
+
+// reencryptItem returns selector and update of record encrypted with current key. Selector matches
+// record only in state it was read, so concurrent save is not overwritten
+func (t MongoStorage) reencryptItem(item mongoItem) (bson.M, bson.M, error) {
+	if item.Envelope.KeyID == "" {
+		// Compressed value is encrypted as it is
+		payload := item.Envelope.Data
+		if payload == nil {
+			var err error
+			if payload, err = bson.Marshal(storedValue{Value: item.Value}); err != nil {
+				return nil, nil, err
+			}
+		}
+		sealed, err := t.options.Keyring.seal(payload, item.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bson.M{"key": item.Key, "kid": bson.M{"$exists": false}},
+			bson.M{"$set": sealed, "$unset": bson.M{"value": ""}}, nil
+	}
+	rewrapped, err := t.options.Keyring.rewrap(item.Envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bson.M{"key": item.Key, "kid": item.Envelope.KeyID, "dek": item.Envelope.DataKey},
+		bson.M{"$set": bson.M{"kid": rewrapped.KeyID, "dek": rewrapped.DataKey}}, nil
+}
@@ -0,0 +1,150 @@
+package persist
+
+import (
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encryptedRoundTrip stores encrypted record like MongoDB does and reads it back
+func encryptedRoundTrip(t *testing.T, mongoStorage MongoStorage, key string, value interface{}, ttl int64) (interface{}, int64) {
+	document, err := mongoStorage.document(key, value, ttl, 0)
+	require.NoError(t, err)
+	require.NotContains(t, document, "value")
+	raw, err := bson.Marshal(document)
+	require.NoError(t, err)
+	item := mongoItem{}
+	require.NoError(t, bson.Unmarshal(raw, &item))
+	require.Nil(t, item.Value)
+	require.NoError(t, mongoStorage.unpack(&item))
+	loaded, err := item.decode()
+	require.NoError(t, err)
+	return loaded, item.TTL
+}
+
+func TestMongoEncryption(t *testing.T) {
+	keyring, err := NewKeyring("k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	mongoStorage := MongoStorage{options: MongoOptions{Keyring: keyring}}
+	require.True(t, mongoStorage.Encrypted())
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	loaded := kvstorage.NewKVStorage(4, false)
+	for _, key := range storage.Keys() {
+		value, ttl, ok := storage.GetWithTTL(key)
+		require.True(t, ok)
+		value, ttl = encryptedRoundTrip(t, mongoStorage, key, value, ttl)
+		var duration time.Duration
+		if ttl > 0 {
+			duration = time.Unix(ttl, 0).Sub(time.Now())
+		}
+		loaded.Set(key, value, duration)
+	}
+	checkStorageNumber(t, loaded, 1)
+
+	// Encrypted record can't be loaded without keys
+	document, err := mongoStorage.document("key", "value", 0, 0)
+	require.NoError(t, err)
+	raw, err := bson.Marshal(document)
+	require.NoError(t, err)
+	item := mongoItem{}
+	require.NoError(t, bson.Unmarshal(raw, &item))
+	require.Error(t, MongoStorage{}.unpack(&item))
+}
+
+func TestMongoReencryptItem(t *testing.T) {
+	keyring, err := NewKeyring("k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	rotated, err := NewKeyring("k2:" + testKey(2, 32) + ",k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	mongoStorage := MongoStorage{options: MongoOptions{Keyring: rotated}}
+
+	document, err := MongoStorage{options: MongoOptions{Keyring: keyring}}.document("key", "value", 0, 0)
+	require.NoError(t, err)
+	raw, err := bson.Marshal(document)
+	require.NoError(t, err)
+	item := mongoItem{}
+	require.NoError(t, bson.Unmarshal(raw, &item))
+	selector, update, err := mongoStorage.reencryptItem(item)
+	require.NoError(t, err)
+	require.Equal(t, "k1", selector["kid"])
+	set := update["$set"].(bson.M)
+	require.Equal(t, "k2", set["kid"])
+	item.Envelope.KeyID = set["kid"].(string)
+	item.Envelope.DataKey = set["dek"].([]byte)
+	require.NoError(t, mongoStorage.unpack(&item))
+	require.Equal(t, "value", item.Value)
+
+	plain := mongoItem{Key: "plain", Value: "text", Type: TYPE_GENERAL}
+	selector, update, err = mongoStorage.reencryptItem(plain)
+	require.NoError(t, err)
+	require.Equal(t, bson.M{"$exists": false}, selector["kid"])
+	sealed := update["$set"].(envelope)
+	require.Equal(t, "k2", sealed.KeyID)
+	plain.Value = nil
+	plain.Envelope = sealed
+	require.NoError(t, mongoStorage.unpack(&plain))
+	require.Equal(t, "text", plain.Value)
+}
+
+func TestMongoCompression(t *testing.T) {
+	compressor, err := kvstorage.NewCompressor(64, -1)
+	require.NoError(t, err)
+	keyring, err := NewKeyring("k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	for _, options := range []MongoOptions{{Compressor: compressor}, {Compressor: compressor, Keyring: keyring}} {
+		mongoStorage := MongoStorage{options: options}
+		storage := kvstorage.NewKVStorage(4, false)
+		fillStorage(t, storage)
+		large := map[string]interface{}{"text": strings.Repeat("compressible ", 20), "n": int64(1) << 60}
+		storage.Set("large", large, 0)
+		loaded := kvstorage.NewKVStorage(4, false)
+		for _, key := range storage.Keys() {
+			value, ttl, ok := storage.GetWithTTL(key)
+			require.True(t, ok)
+			document, err := mongoStorage.document(key, value, ttl, 0)
+			require.NoError(t, err)
+			if key == "large" {
+				require.Equal(t, true, document["z"])
+			}
+			raw, err := bson.Marshal(document)
+			require.NoError(t, err)
+			item := mongoItem{}
+			require.NoError(t, bson.Unmarshal(raw, &item))
+			require.NoError(t, mongoStorage.unpack(&item))
+			value, err = item.decode()
+			require.NoError(t, err)
+			var duration time.Duration
+			if item.TTL > 0 {
+				duration = time.Unix(item.TTL, 0).Sub(time.Now())
+			}
+			loaded.Set(key, value, duration)
+		}
+		checkStorageNumber(t, loaded, 1)
+		value, _ := loaded.Get("large")
+		require.Equal(t, large, value)
+	}
+	stats, ok := MongoStorage{options: MongoOptions{Compressor: compressor}}.CompressionStats()
+	require.True(t, ok)
+	require.Equal(t, int64(2), stats.Values)
+	require.True(t, stats.Ratio > 1)
+	_, ok = MongoStorage{}.CompressionStats()
+	require.False(t, ok)
+
+	// Compressed record is encrypted as it is
+	document, err := MongoStorage{options: MongoOptions{Compressor: compressor}}.document("large", strings.Repeat("a", 100), 0, 0)
+	require.NoError(t, err)
+	raw, err := bson.Marshal(document)
+	require.NoError(t, err)
+	item := mongoItem{}
+	require.NoError(t, bson.Unmarshal(raw, &item))
+	mongoStorage := MongoStorage{options: MongoOptions{Keyring: keyring}}
+	_, update, err := mongoStorage.reencryptItem(item)
+	require.NoError(t, err)
+	item.Envelope = update["$set"].(envelope)
+	require.NoError(t, mongoStorage.unpack(&item))
+	require.Equal(t, strings.Repeat("a", 100), item.Value)
+}
@@ -0,0 +1,140 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"sort"
+	"time"
+)
+
+// Generations of snapshot are copies of collection made by full saves. They are listed in collection with
+// GENERATIONS_SUFFIX and stored in collections named with GENERATION_INFIX and generation ID
+const (
+	GENERATIONS_SUFFIX   = "_generations"
+	GENERATION_INFIX     = "_gen_"
+	GENERATION_ID_LAYOUT = "20060102T150405.000Z"
+)
+
+// ErrGenerationNotFound is returned on restore of unknown generation
+var ErrGenerationNotFound = errors.New("Snapshot generation not found")
+
+// Generation is snapshot saved at given time which can be restored
+type Generation struct {
+	ID      string    `json:"id" bson:"id"`
+	Created time.Time `json:"created" bson:"created"`
+	Keys    int64     `json:"keys" bson:"keys"`
+}
+
+// GenerationStorage is persistent storage which keeps generations of snapshots. Generations are ordered
+// from the newest one
+type GenerationStorage interface {
+	Generations() ([]Generation, error)
+	RestoreGeneration(ctx context.Context, id string, storage *kvstorage.Storage) error
+}
+
+// expiredGenerations returns generations which are not kept by retention policy. The newest count
+// generations not older than maxAge are kept. Zero count or maxAge means no limit
+func expiredGenerations(generations []Generation, count int, maxAge time.Duration, now time.Time) []Generation {
+	sorted := append([]Generation{}, generations...)
+	sort.Slice(sorted, func(i, k int) bool { return sorted[i].Created.After(sorted[k].Created) })
+	var expired []Generation
+	for i, generation := range sorted {
+		if (count > 0 && i >= count) || (maxAge > 0 && now.Sub(generation.Created) > maxAge) {
+			expired = append(expired, generation)
+		}
+	}
+	return expired
+}
+
+// copyGeneration copies saved snapshot to collection of new generation. Generation is not listed until
+// it is recorded
+func (t MongoStorage) copyGeneration(c *mgo.Collection, saved manifest) (Generation, error) {
+	created := time.Now().UTC()
+	generation := Generation{ID: created.Format(GENERATION_ID_LAYOUT), Created: created, Keys: saved.Keys}
+	var result []bson.M
+	if err := c.Pipe([]bson.M{{"$out": t.collection + GENERATION_INFIX + generation.ID}}).All(&result); err != nil {
+		return Generation{}, err
+	}
+	return generation, nil
+}
+
+// recordGeneration saves manifest of copied generation and lists it
+func (t MongoStorage) recordGeneration(session *mgo.Session, generation Generation, saved manifest) error {
+	saved.Collection = t.collection + GENERATION_INFIX + generation.ID
+	if err := t.saveManifest(session, saved); err != nil {
+		return err
+	}
+	generations := session.DB(t.dbName).C(t.collection + GENERATIONS_SUFFIX)
+	_, err := generations.Upsert(bson.M{"id": generation.ID}, generation)
+	return err
+}
+
+// dropGeneration drops collection, manifest and list entry of generation
+func (t MongoStorage) dropGeneration(session *mgo.Session, id string) error {
+	db := session.DB(t.dbName)
+	collection := t.collection + GENERATION_INFIX + id
+	if err := db.C(collection).DropCollection(); err != nil && err.Error() != "ns not found" {
+		return err
+	}
+	if err := t.removeManifest(session, collection); err != nil {
+		return err
+	}
+	if err := db.C(t.collection + GENERATIONS_SUFFIX).Remove(bson.M{"id": id}); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// pruneGenerations drops generations expired by retention policy. Failed drop is retried after next save
+func (t MongoStorage) pruneGenerations(ctx context.Context) {
+	generations, err := t.Generations()
+	if err != nil {
+		log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Can't list snapshot generations", err))
+		return
+	}
+	for _, generation := range expiredGenerations(generations, t.options.Generations, t.options.GenerationMaxAge, time.Now()) {
+		err := t.withRetry(ctx, func(session *mgo.Session) error {
+			return t.dropGeneration(session, generation.ID)
+		})
+		if err != nil {
+			log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Can't drop snapshot generation "+generation.ID, err))
+			continue
+		}
+		log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_ID, "Dropped snapshot generation "+generation.ID, nil))
+	}
+}
+
+// Generations returns saved generations of snapshot from the newest one
+func (t MongoStorage) Generations() ([]Generation, error) {
+	var generations []Generation
+	err := t.withRetry(context.Background(), func(session *mgo.Session) error {
+		generations = []Generation{}
+		return session.DB(t.dbName).C(t.collection + GENERATIONS_SUFFIX).Find(nil).Sort("-created").All(&generations)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return generations, nil
+}
+
+// RestoreGeneration loads records of generation which are not expired
+func (t MongoStorage) RestoreGeneration(ctx context.Context, id string, storage *kvstorage.Storage) error {
+	found := true
+	err := t.withRetry(ctx, func(session *mgo.Session) error {
+		count, err := session.DB(t.dbName).C(t.collection + GENERATIONS_SUFFIX).Find(bson.M{"id": id}).Count()
+		found = count > 0
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrGenerationNotFound
+	}
+	return t.loadCollection(ctx, t.collection+GENERATION_INFIX+id, storage)
+}
@@ -0,0 +1,29 @@
+package persist
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExpiredGenerations(t *testing.T) {
+	now := time.Now()
+	generations := []Generation{
+		{ID: "3", Created: now.Add(-3 * time.Hour)},
+		{ID: "1", Created: now.Add(-time.Minute)},
+		{ID: "4", Created: now.Add(-48 * time.Hour)},
+		{ID: "2", Created: now.Add(-time.Hour)},
+	}
+	ids := func(generations []Generation) []string {
+		res := []string{}
+		for _, generation := range generations {
+			res = append(res, generation.ID)
+		}
+		return res
+	}
+	require.Equal(t, []string{"3", "4"}, ids(expiredGenerations(generations, 2, 0, now)))
+	require.Equal(t, []string{"4"}, ids(expiredGenerations(generations, 0, 24*time.Hour, now)))
+	require.Equal(t, []string{"2", "3", "4"}, ids(expiredGenerations(generations, 3, 30*time.Minute, now)))
+	require.Empty(t, expiredGenerations(generations, 0, 0, now))
+	require.Equal(t, "3", generations[0].ID)
+}
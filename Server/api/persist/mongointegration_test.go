@@ -0,0 +1,63 @@
+package persist
+
+import (
+	"encoding/json"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMongoIntegration saves and loads storage with MongoDB given by MONGO_TEST_URL (e.g. mongodb://127.0.0.1:27017).
+// Test database is dropped afterwards
+func TestMongoIntegration(t *testing.T) {
+	address := os.Getenv("MONGO_TEST_URL")
+	if address == "" {
+		t.Skip("MONGO_TEST_URL is not set")
+	}
+	dbName := "kvserver_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	session, err := mgo.DialWithTimeout(address, 5*time.Second)
+	require.NoError(t, err)
+	defer session.Close()
+	defer session.DB(dbName).DropDatabase()
+
+	mongoStorage := NewMongoStorage(address, dbName, "data")
+	defer mongoStorage.Close()
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	numbers := []interface{}{json.Number("7"), json.Number("0.5"), json.Number("12345678901234567890123")}
+	storage.Set("numbers", numbers, 0)
+	require.NoError(t, mongoStorage.SaveToDb(storage))
+
+	// Numbers are native BSON unless they would lose precision
+	var stored bson.M
+	require.NoError(t, session.DB(dbName).C("data").Find(bson.M{"key": "numbers"}).One(&stored))
+	require.Equal(t, []interface{}{int64(7), 0.5, bson.M{bsonTypeField: bsonTypeNumber, bsonValueField: "12345678901234567890123"}}, stored["value"])
+
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, mongoStorage.LoadFromDb(loaded))
+	checkStorageNumber(t, loaded, 1)
+	value, _ := loaded.Get("numbers")
+	require.Equal(t, []interface{}{7, 0.5, json.Number("12345678901234567890123")}, value)
+
+	// Collection which doesn't match its manifest doesn't change storage
+	require.NoError(t, session.DB(dbName).C("data").Update(bson.M{"key": "general"}, bson.M{"$set": bson.M{"value": "forged"}}))
+	refused := kvstorage.NewKVStorage(4, false)
+	refused.Set("kept", "value", 0)
+	require.Error(t, mongoStorage.LoadFromDb(refused))
+	require.Equal(t, []string{"kept"}, refused.Keys())
+
+	storage.Set("general", "changed", 0)
+	require.NoError(t, storage.Remove("numbers"))
+	require.NoError(t, mongoStorage.SaveChangesToDb(storage))
+	loaded = kvstorage.NewKVStorage(4, false)
+	require.NoError(t, mongoStorage.LoadFromDb(loaded))
+	value, _ = loaded.Get("general")
+	require.Equal(t, "changed", value)
+	_, ok := loaded.Get("numbers")
+	require.False(t, ok)
+}
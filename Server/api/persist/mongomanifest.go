@@ -0,0 +1,110 @@
+package persist
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"sync/atomic"
+)
+
+// Manifests of collections are kept in collection with MANIFESTS_SUFFIX. Manifest is written by full save
+// and removed by every partial change of collection, so only collections written at once are verified
+const MANIFESTS_SUFFIX = "_manifests"
+
+// manifest is number of records and content hash of collection saved at once
+type manifest struct {
+	Collection string `bson:"collection"`
+	Keys       int64  `bson:"keys"`
+	Hash       string `bson:"hash"`
+}
+
+// contentHash is hash of records which doesn't depend on their order, so shards can be hashed in parallel.
+// It is sum of first 8 bytes of SHA-256 of every record
+type contentHash struct {
+	keys int64
+	sum  uint64
+}
+
+// add adds record to hash
+func (t *contentHash) add(record bson.RawD) {
+	atomic.AddInt64(&t.keys, 1)
+	atomic.AddUint64(&t.sum, recordHash(record))
+}
+
+// String formats hash as hex
+func (t *contentHash) String() string {
+	return strconv.FormatUint(atomic.LoadUint64(&t.sum), 16)
+}
+
+// manifest returns manifest of hashed collection
+func (t *contentHash) manifest(collection string) manifest {
+	return manifest{Collection: collection, Keys: atomic.LoadInt64(&t.keys), Hash: t.String()}
+}
+
+// recordHash hashes fields of record except of ID added by MongoDB
+func recordHash(record bson.RawD) uint64 {
+	h := sha256.New()
+	var size [4]byte
+	for _, field := range record {
+		if field.Name == "_id" {
+			continue
+		}
+		h.Write([]byte(field.Name))
+		h.Write([]byte{0, field.Value.Kind})
+		binary.BigEndian.PutUint32(size[:], uint32(len(field.Value.Data)))
+		h.Write(size[:])
+		h.Write(field.Value.Data)
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// rawRecord marshals document to record which keeps order of fields, so stored record has the same hash
+func rawRecord(document interface{}) (bson.RawD, error) {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var record bson.RawD
+	if err := bson.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// verify checks that loaded records match manifest
+func (t manifest) verify(hash *contentHash) error {
+	loaded := hash.manifest(t.Collection)
+	if loaded.Keys != t.Keys || loaded.Hash != t.Hash {
+		return errors.New("Snapshot verification failed: " + t.Collection + " was saved with " + strconv.FormatInt(t.Keys, 10) +
+			" records and hash " + t.Hash + ", loaded " + strconv.FormatInt(loaded.Keys, 10) + " records with hash " + loaded.Hash)
+	}
+	return nil
+}
+
+// saveManifest replaces manifest of collection
+func (t MongoStorage) saveManifest(session *mgo.Session, value manifest) error {
+	_, err := session.DB(t.dbName).C(t.collection+MANIFESTS_SUFFIX).Upsert(bson.M{"collection": value.Collection}, value)
+	return err
+}
+
+// removeManifest removes manifest of collection before it is changed
+func (t MongoStorage) removeManifest(session *mgo.Session, collection string) error {
+	_, err := session.DB(t.dbName).C(t.collection + MANIFESTS_SUFFIX).RemoveAll(bson.M{"collection": collection})
+	return err
+}
+
+// loadManifest returns manifest of collection. Nil means that collection can't be verified
+func (t MongoStorage) loadManifest(session *mgo.Session, collection string) (*manifest, error) {
+	value := &manifest{}
+	err := session.DB(t.dbName).C(t.collection + MANIFESTS_SUFFIX).Find(bson.M{"collection": collection}).One(value)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
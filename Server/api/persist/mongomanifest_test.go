@@ -0,0 +1,52 @@
+package persist
+
+import (
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestContentHash(t *testing.T) {
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	saved := &contentHash{}
+	var stored []bson.Raw
+	for _, key := range storage.Keys() {
+		value, ttl, _ := storage.GetWithTTL(key)
+		record, err := rawRecord(toDocument(key, value, ttl))
+		require.NoError(t, err)
+		saved.add(record)
+		// MongoDB adds ID to inserted record
+		data, err := bson.Marshal(append(bson.RawD{{Name: "_id", Value: bson.Raw{Kind: 0x07, Data: []byte(bson.NewObjectId())}}}, record...))
+		require.NoError(t, err)
+		stored = append(stored, bson.Raw{Kind: 0x03, Data: data})
+	}
+	expected := saved.manifest("data")
+	require.Equal(t, int64(len(storage.Keys())), expected.Keys)
+
+	load := func(records []bson.Raw) *contentHash {
+		loaded := &contentHash{}
+		for _, raw := range records {
+			var record bson.RawD
+			require.NoError(t, raw.Unmarshal(&record))
+			loaded.add(record)
+			item := mongoItem{}
+			require.NoError(t, raw.Unmarshal(&item))
+			_, err := item.decode()
+			require.NoError(t, err)
+		}
+		return loaded
+	}
+	// Order of records doesn't matter
+	reversed := make([]bson.Raw, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		reversed = append(reversed, stored[i])
+	}
+	require.NoError(t, expected.verify(load(reversed)))
+	require.Error(t, expected.verify(load(stored[1:])))
+
+	changed, err := bson.Marshal(bson.M{"key": "changed", "value": "value", "type": TYPE_GENERAL, "ttl": int64(0)})
+	require.NoError(t, err)
+	require.Error(t, expected.verify(load(append([]bson.Raw{{Kind: 0x03, Data: changed}}, stored[1:]...))))
+}
@@ -0,0 +1,256 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"gopkg.in/mgo.v2"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MongoOptions are connection settings of MongoDB storage
+type MongoOptions struct {
+	// Timeout of dial, socket operations and waiting for available server
+	Timeout time.Duration
+	// WriteConcern is number of members which acknowledge write or "majority"
+	WriteConcern string
+	// ReadPreference is primary, primaryPreferred, secondary, secondaryPreferred or nearest
+	ReadPreference string
+	// Retries is number of retries of operation failed because of network or replica set failure
+	Retries int
+	// RetryBackoff is delay before first retry. It is doubled for every next retry
+	RetryBackoff time.Duration
+	// BulkSize is number of documents written at once
+	BulkSize int
+	// Workers is number of shards saved or loaded in parallel
+	Workers int
+	// Keyring encrypts values. Nil disables encryption
+	Keyring *Keyring
+	// Compressor compresses large values. Nil disables compression
+	Compressor *kvstorage.Compressor
+	// KeepGenerations makes full saves keep generations of snapshot
+	KeepGenerations bool
+	// Generations is number of kept snapshot generations. Zero means no limit
+	Generations int
+	// GenerationMaxAge is age after which generations are dropped. Zero means no limit
+	GenerationMaxAge time.Duration
+}
+
+// DefaultMongoOptions are used by NewMongoStorage
+var DefaultMongoOptions = MongoOptions{
+	Timeout:        10 * time.Second,
+	WriteConcern:   "1",
+	ReadPreference: "primary",
+	Retries:        3,
+	RetryBackoff:   100 * time.Millisecond,
+	BulkSize:       BULK_SIZE,
+	Workers:        4,
+}
+
+var readPreferences = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// Codes of server errors which go away after failover
+var transientCodes = map[int]bool{6: true, 7: true, 89: true, 91: true, 189: true, 10107: true, 11600: true, 11602: true, 13435: true, 13436: true}
+
+// Messages of network and failover errors which have no code
+var transientMessages = []string{"no reachable servers", "Closed explicitly", "not master", "connection reset", "broken pipe", "i/o timeout"}
+
+// Health is state of connection to persistent storage
+type Health struct {
+	Healthy       bool      `json:"healthy"`
+	LastSuccess   time.Time `json:"lastSuccess"`
+	LastError     string    `json:"lastError"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+	Retries       int64     `json:"retries"`
+	Failures      int64     `json:"failures"`
+	// LastSave and LastLoad are reported by storages which measure throughput
+	LastSave Throughput `json:"lastSave"`
+	LastLoad Throughput `json:"lastLoad"`
+}
+
+// HealthChecker is persistent storage which checks its connection
+type HealthChecker interface {
+	Health() Health
+}
+
+// mongoSession is long-lived session. Every operation works with its copy
+type mongoSession struct {
+	sync.Mutex
+	session *mgo.Session
+	health  Health
+}
+
+// validate checks connection settings
+func (t MongoOptions) validate() error {
+	if t.Timeout <= 0 {
+		return errors.New("MongoDB timeout must be positive")
+	}
+	if t.Retries < 0 || t.RetryBackoff < 0 {
+		return errors.New("MongoDB retries and retry backoff can't be negative")
+	}
+	if t.BulkSize <= 0 || t.Workers <= 0 {
+		return errors.New("MongoDB bulk size and number of workers must be positive")
+	}
+	if t.Generations < 0 || t.GenerationMaxAge < 0 {
+		return errors.New("Number and age of snapshot generations can't be negative")
+	}
+	if !t.KeepGenerations && (t.Generations > 0 || t.GenerationMaxAge > 0) {
+		return errors.New("Number and age of snapshot generations are limited, but generations are not kept")
+	}
+	if _, ok := readPreferences[t.ReadPreference]; !ok {
+		return errors.New("Unknown MongoDB read preference: " + t.ReadPreference)
+	}
+	_, err := t.safe()
+	return err
+}
+
+// safe returns write concern settings. Nil means unacknowledged writes
+func (t MongoOptions) safe() (*mgo.Safe, error) {
+	if t.WriteConcern == "majority" {
+		return &mgo.Safe{WMode: "majority"}, nil
+	}
+	w, err := strconv.Atoi(t.WriteConcern)
+	if err != nil || w < 0 {
+		return nil, errors.New("Unknown MongoDB write concern: " + t.WriteConcern)
+	}
+	if w == 0 {
+		return nil, nil
+	}
+	return &mgo.Safe{W: w}, nil
+}
+
+// getConnection returns copy of long-lived session. Session is dialed on first use
+func (t MongoStorage) getConnection() (*mgo.Session, error) {
+	t.pool.Lock()
+	defer t.pool.Unlock()
+	if t.pool.session == nil {
+		session, err := mgo.DialWithTimeout(t.connectionString, t.options.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		safe, _ := t.options.safe()
+		session.SetMode(readPreferences[t.options.ReadPreference], true)
+		session.SetSafe(safe)
+		session.SetSocketTimeout(t.options.Timeout)
+		session.SetSyncTimeout(t.options.Timeout)
+		t.pool.session = session
+	}
+	return t.pool.session.Copy(), nil
+}
+
+// withRetry runs operation with copy of session. Operation failed because of network or failover is retried
+// with exponential backoff, so it must be idempotent
+func (t MongoStorage) withRetry(ctx context.Context, operation func(*mgo.Session) error) error {
+	backoff := t.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		session, err := t.getConnection()
+		if err == nil {
+			err = operation(session)
+			session.Close()
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		t.pool.report(err)
+		if err == nil || attempt >= t.options.Retries || !isTransient(err) {
+			return err
+		}
+		t.pool.retry()
+		log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Retrying MongoDB operation in "+backoff.String(), err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// report remembers result of operation
+func (t *mongoSession) report(err error) {
+	t.Lock()
+	defer t.Unlock()
+	if err == nil {
+		t.health.LastSuccess = time.Now()
+		return
+	}
+	t.health.Failures++
+	t.health.LastError = err.Error()
+	t.health.LastErrorTime = time.Now()
+}
+
+// retry counts retry and makes session reconnect
+func (t *mongoSession) retry() {
+	t.Lock()
+	defer t.Unlock()
+	t.health.Retries++
+	if t.session != nil {
+		t.session.Refresh()
+	}
+}
+
+// isTransient reports whether error is caused by network or replica set failover
+func isTransient(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	switch e := err.(type) {
+	case *mgo.LastError:
+		if transientCodes[e.Code] {
+			return true
+		}
+	case *mgo.QueryError:
+		if transientCodes[e.Code] {
+			return true
+		}
+	}
+	message := err.Error()
+	for _, transient := range transientMessages {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// Health pings MongoDB and returns state of connection
+func (t MongoStorage) Health() Health {
+	session, err := t.getConnection()
+	if err == nil {
+		err = session.Ping()
+		session.Close()
+	}
+	t.pool.report(err)
+	t.pool.Lock()
+	defer t.pool.Unlock()
+	health := t.pool.health
+	health.Healthy = err == nil
+	return health
+}
+
+// Close closes long-lived session
+func (t MongoStorage) Close() error {
+	t.pool.Lock()
+	defer t.pool.Unlock()
+	if t.pool.session != nil {
+		t.pool.session.Close()
+		t.pool.session = nil
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package persist
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMongoOptions(t *testing.T) {
+	require.NoError(t, DefaultMongoOptions.validate())
+	options := DefaultMongoOptions
+	options.WriteConcern = "majority"
+	safe, err := options.safe()
+	require.NoError(t, err)
+	require.Equal(t, "majority", safe.WMode)
+	options.WriteConcern = "0"
+	safe, err = options.safe()
+	require.NoError(t, err)
+	require.Nil(t, safe)
+	options.WriteConcern = "all"
+	require.Error(t, options.validate())
+
+	options = DefaultMongoOptions
+	options.ReadPreference = "secondaryOnly"
+	require.Error(t, options.validate())
+	options = DefaultMongoOptions
+	options.Timeout = 0
+	require.Error(t, options.validate())
+	options = DefaultMongoOptions
+	options.Workers = 0
+	require.Error(t, options.validate())
+	options = DefaultMongoOptions
+	options.Generations = -1
+	require.Error(t, options.validate())
+	options = DefaultMongoOptions
+	options.GenerationMaxAge = time.Hour
+	require.Error(t, options.validate())
+	options.KeepGenerations = true
+	require.NoError(t, options.validate())
+	options = DefaultMongoOptions
+	options.Retries = -1
+	_, err = NewMongoStorageWithOptions("localhost", "db", "data", options)
+	require.Error(t, err)
+}
+
+func TestIsTransient(t *testing.T) {
+	require.True(t, isTransient(io.EOF))
+	require.True(t, isTransient(&net.OpError{Op: "read", Err: errors.New("connection refused")}))
+	require.True(t, isTransient(errors.New("no reachable servers")))
+	require.True(t, isTransient(&mgo.LastError{Code: 10107, Err: "not master"}))
+	require.True(t, isTransient(&mgo.QueryError{Code: 189, Message: "primary stepped down"}))
+	require.False(t, isTransient(&mgo.LastError{Code: 11000, Err: "duplicate key"}))
+	require.False(t, isTransient(mgo.ErrNotFound))
+	require.False(t, isTransient(errors.New("ns not found")))
+}
+
+func TestMongoRetry(t *testing.T) {
+	options := MongoOptions{
+		Timeout:        100 * time.Millisecond,
+		WriteConcern:   "1",
+		ReadPreference: "primary",
+		Retries:        1,
+		RetryBackoff:   time.Millisecond,
+		BulkSize:       BULK_SIZE,
+		Workers:        1,
+	}
+	// Nothing listens on port 1, so every dial fails with transient error
+	mongoStorage, err := NewMongoStorageWithOptions("127.0.0.1:1", "db", "data", options)
+	require.NoError(t, err)
+	defer mongoStorage.Close()
+	require.Error(t, mongoStorage.SaveSchemas(map[string]interface{}{}))
+	health := mongoStorage.Health()
+	require.False(t, health.Healthy)
+	require.Equal(t, int64(1), health.Retries)
+	require.Equal(t, int64(3), health.Failures)
+	require.Contains(t, health.LastError, "no reachable servers")
+	require.True(t, health.LastSuccess.IsZero())
+}
@@ -0,0 +1,101 @@
+package persist
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/logs"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SHARD_FIELD keeps index of storage chunk of record. Records are saved and loaded by shards in parallel
+const SHARD_FIELD = "shard"
+
+// Throughput is size and speed of last save or load
+type Throughput struct {
+	Keys          int64     `json:"keys"`
+	Duration      string    `json:"duration"`
+	KeysPerSecond float64   `json:"keysPerSecond"`
+	Finished      time.Time `json:"finished"`
+}
+
+// newThroughput measures operation started at given time
+func newThroughput(keys int64, started time.Time) Throughput {
+	duration := time.Since(started)
+	throughput := Throughput{Keys: keys, Duration: duration.String(), Finished: time.Now()}
+	if duration > 0 {
+		throughput.KeysPerSecond = float64(keys) / duration.Seconds()
+	}
+	return throughput
+}
+
+// String formats throughput for logs
+func (t Throughput) String() string {
+	return strconv.FormatInt(t.Keys, 10) + " keys in " + t.Duration + " (" + strconv.FormatFloat(t.KeysPerSecond, 'f', 0, 64) + " keys/s)"
+}
+
+// parallel runs task for every shard in given number of workers. First error stops remaining tasks
+func parallel(ctx context.Context, shards, workers int, task func(ctx context.Context, shard int) error) error {
+	if workers > shards {
+		workers = shards
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	queue := make(chan int, shards)
+	for shard := 0; shard < shards; shard++ {
+		queue <- shard
+	}
+	close(queue)
+	var once sync.Once
+	var firstErr error
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := task(ctx, shard); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil {
+		// Shards skipped after cancellation are not processed
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// shardFilters returns queries which split collection between workers. Records saved before
+// sharding have no shard field and are loaded by separate query
+func shardFilters(workers int) []bson.M {
+	filters := make([]bson.M, 0, workers+1)
+	for i := 0; i < workers; i++ {
+		filters = append(filters, bson.M{SHARD_FIELD: bson.M{"$mod": []int{workers, i}}})
+	}
+	return append(filters, bson.M{SHARD_FIELD: bson.M{"$exists": false}})
+}
+
+// measure remembers and logs throughput of save or load
+func (t *mongoSession) measure(operation string, keys int64, started time.Time) {
+	throughput := newThroughput(keys, started)
+	t.Lock()
+	if operation == "save" {
+		t.health.LastSave = throughput
+	} else {
+		t.health.LastLoad = throughput
+	}
+	t.Unlock()
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_ID, "MongoDB "+operation+": "+throughput.String(), nil))
+}
@@ -0,0 +1,61 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallel(t *testing.T) {
+	mutex := sync.Mutex{}
+	done := map[int]bool{}
+	err := parallel(context.Background(), 10, 3, func(ctx context.Context, shard int) error {
+		mutex.Lock()
+		done[shard] = true
+		mutex.Unlock()
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, done, 10)
+
+	failed := errors.New("failed")
+	err = parallel(context.Background(), 100, 2, func(ctx context.Context, shard int) error {
+		if shard == 0 {
+			return failed
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.Equal(t, failed, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = parallel(ctx, 5, 10, func(ctx context.Context, shard int) error {
+		return ctx.Err()
+	})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestShardFilters(t *testing.T) {
+	filters := shardFilters(3)
+	require.Len(t, filters, 4)
+	require.Equal(t, bson.M{SHARD_FIELD: bson.M{"$mod": []int{3, 2}}}, filters[2])
+	require.Equal(t, bson.M{SHARD_FIELD: bson.M{"$exists": false}}, filters[3])
+}
+
+func TestThroughput(t *testing.T) {
+	throughput := newThroughput(1000, time.Now().Add(-2*time.Second))
+	require.Equal(t, int64(1000), throughput.Keys)
+	require.InDelta(t, 500, throughput.KeysPerSecond, 10)
+	require.Contains(t, throughput.String(), "1000 keys in ")
+
+	pool := &mongoSession{}
+	pool.measure("save", 10, time.Now())
+	pool.measure("load", 20, time.Now())
+	require.Equal(t, int64(10), pool.health.LastSave.Keys)
+	require.Equal(t, int64(20), pool.health.LastLoad.Keys)
+}
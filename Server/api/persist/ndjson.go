@@ -0,0 +1,187 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONRecord is one line of newline-delimited JSON export. TTL is unix time (0 means no TTL).
+// Value of geo set is list of members, value of stream is its dump
+type JSONRecord struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	TTL   int64           `json:"ttl"`
+	Value json.RawMessage `json:"value"`
+}
+
+// valueType returns type of stored value
+func valueType(value interface{}) string {
+	switch value.(type) {
+	case []interface{}:
+		return TYPE_LIST
+	case map[string]interface{}:
+		return TYPE_DICT
+	case []byte:
+		return TYPE_BITMAP
+	case *kvstorage.GeoSet:
+		return TYPE_GEO
+	case *kvstorage.Stream:
+		return TYPE_STREAM
+	}
+	return TYPE_GENERAL
+}
+
+// newJSONRecord encodes record to JSON
+func newJSONRecord(key string, value interface{}, ttl int64) (JSONRecord, error) {
+	data := value
+	switch v := value.(type) {
+	case *kvstorage.GeoSet:
+		data = v.Members()
+	case *kvstorage.Stream:
+		data = v.Dump()
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return JSONRecord{}, err
+	}
+	return JSONRecord{Key: key, Type: valueType(value), TTL: ttl, Value: raw}, nil
+}
+
+// unmarshalJSON decodes JSON like HTTP handlers do: numbers are json.Number, so that integers keep exact values
+func unmarshalJSON(raw []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(value); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("Unexpected data after JSON value")
+	}
+	return nil
+}
+
+// decodeValue restores value of record of given type. Numbers are restored as json.Number
+func decodeValue(vType string, raw json.RawMessage) (interface{}, error) {
+	switch vType {
+	case TYPE_BITMAP:
+		var value []byte
+		err := unmarshalJSON(raw, &value)
+		return value, err
+	case TYPE_GEO:
+		var members []kvstorage.GeoMember
+		if err := unmarshalJSON(raw, &members); err != nil {
+			return nil, err
+		}
+		geoSet := kvstorage.NewGeoSet()
+		geoSet.Add(members...)
+		return geoSet, nil
+	case TYPE_STREAM:
+		var dump kvstorage.StreamDump
+		if err := unmarshalJSON(raw, &dump); err != nil {
+			return nil, err
+		}
+		return kvstorage.NewStreamFromDump(dump)
+	}
+	var value interface{}
+	err := unmarshalJSON(raw, &value)
+	return value, err
+}
+
+// ExportNDJSON writes keys with given prefix as newline-delimited JSON records one by one.
+// Returns number of written records
+func ExportNDJSON(ctx context.Context, writer io.Writer, storage *kvstorage.Storage, prefix string) (int, error) {
+	encoder := json.NewEncoder(writer)
+	count := 0
+	for _, key := range storage.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := keyDone(ctx); err != nil {
+			return count, err
+		}
+		value, ttl, ok := storage.GetWithTTL(key)
+		if !ok {
+			continue
+		}
+		record, err := newJSONRecord(key, value, ttl)
+		if err != nil {
+			return count, errors.New("Can't export key " + key + ": " + err.Error())
+		}
+		if err := encoder.Encode(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// BrokenRecord is error of NDJSON record which can't be decoded
+type BrokenRecord struct {
+	Line   int
+	Reason string
+}
+
+func (t BrokenRecord) Error() string {
+	return "Broken record " + strconv.Itoa(t.Line) + ": " + t.Reason
+}
+
+// ReadNDJSON decodes newline-delimited JSON records one by one and passes them to apply. Expired records are
+// skipped. Reading stops at first broken record (BrokenRecord error) or error returned by apply
+func ReadNDJSON(ctx context.Context, reader io.Reader, apply func(key string, value interface{}, ttl time.Duration) error) error {
+	decoder := json.NewDecoder(reader)
+	currentTime := time.Now().Unix()
+	for line := 1; ; line++ {
+		var record JSONRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return BrokenRecord{Line: line, Reason: err.Error()}
+		}
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
+		if record.Key == "" {
+			return BrokenRecord{Line: line, Reason: "key is empty"}
+		}
+		switch record.Type {
+		case TYPE_GENERAL, TYPE_LIST, TYPE_DICT, TYPE_BITMAP, TYPE_GEO, TYPE_STREAM:
+		default:
+			return BrokenRecord{Line: line, Reason: "unknown type " + record.Type}
+		}
+		value, err := decodeValue(record.Type, record.Value)
+		if err != nil {
+			return BrokenRecord{Line: line, Reason: err.Error()}
+		}
+		if record.TTL > 0 && record.TTL <= currentTime {
+			continue
+		}
+		var ttl time.Duration
+		if record.TTL > 0 {
+			ttl = time.Unix(record.TTL, 0).Sub(time.Now())
+		}
+		if err := apply(record.Key, value, ttl); err != nil {
+			return err
+		}
+	}
+}
+
+// ImportNDJSON loads newline-delimited JSON records to storage. Expired records are skipped.
+// Returns number of loaded records
+func ImportNDJSON(ctx context.Context, reader io.Reader, storage *kvstorage.Storage) (int, error) {
+	count := 0
+	err := ReadNDJSON(ctx, reader, func(key string, value interface{}, ttl time.Duration) error {
+		storage.Set(key, value, ttl)
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,58 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestNDJSON(t *testing.T) {
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	buf := &bytes.Buffer{}
+	count, err := ExportNDJSON(context.Background(), buf, storage, "")
+	require.NoError(t, err)
+	require.Equal(t, 6, count)
+	require.Equal(t, 6, strings.Count(buf.String(), "\n"))
+
+	loaded := kvstorage.NewKVStorage(4, false)
+	count, err = ImportNDJSON(context.Background(), buf, loaded)
+	require.NoError(t, err)
+	require.Equal(t, 6, count)
+	checkStorage(t, loaded)
+
+	buf.Reset()
+	count, err = ExportNDJSON(context.Background(), buf, storage, "li")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Equal(t, `{"key":"list","type":"list","ttl":0,"value":[1,"two"]}`+"\n", buf.String())
+
+	// Integers which don't fit in float64 keep exact value
+	storage.Set("big", map[string]interface{}{"id": int64(1)<<60 + 1}, 0)
+	buf.Reset()
+	_, err = ExportNDJSON(context.Background(), buf, storage, "big")
+	require.NoError(t, err)
+	_, err = ImportNDJSON(context.Background(), buf, loaded)
+	require.NoError(t, err)
+	value, _ := loaded.Get("big")
+	require.Equal(t, map[string]interface{}{"id": json.Number("1152921504606846977")}, value)
+}
+
+func TestNDJSONBrokenRecord(t *testing.T) {
+	storage := kvstorage.NewKVStorage(4, false)
+	input := `{"key":"a","type":"general","ttl":0,"value":1}
+{"key":"b","type":"unknown","ttl":0,"value":1}
+`
+	count, err := ImportNDJSON(context.Background(), strings.NewReader(input), storage)
+	require.EqualError(t, err, "Broken record 2: unknown type unknown")
+	require.Equal(t, 1, count)
+	_, err = ImportNDJSON(context.Background(), strings.NewReader(`{"key":"a",`), storage)
+	require.Error(t, err)
+	count, err = ImportNDJSON(context.Background(), strings.NewReader(`{"key":"expired","type":"general","ttl":1,"value":1}`), storage)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
@@ -1,75 +1,331 @@
 package persist
 
 import (
+	"context"
+	"errors"
 	"github.com/Labutin/KVServer/Server/logs"
 	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type PersistStorage interface {
 	SaveToDb(*kvstorage.Storage) error
+	SaveChangesToDb(*kvstorage.Storage) error
 	LoadFromDb(*kvstorage.Storage) error
+	SaveSchemas(map[string]interface{}) error
+	LoadSchemas() (map[string]interface{}, error)
+}
+
+// KeyWriter is persistent storage which can save separate keys
+type KeyWriter interface {
+	SaveKeys(*kvstorage.Storage, []string) error
+}
+
+// KeyLoader is persistent storage which can load separate keys. It returns value, TTL and whether key was found
+type KeyLoader interface {
+	LoadKey(string) (interface{}, int64, bool, error)
+}
+
+// CompressionReporter is persistent storage which can compress documents. It returns totals of compressed
+// documents and whether compression is enabled
+type CompressionReporter interface {
+	CompressionStats() (kvstorage.CompressionStats, bool)
 }
 
 type MongoStorage struct {
 	connectionString string
 	dbName           string
 	collection       string
+	options          MongoOptions
+	pool             *mongoSession
 }
 
 const (
-	TYPE_GENERAL = "general"
-	TYPE_LIST    = "list"
-	TYPE_DICT    = "dict"
-	GOROUTINE_ID = "persist"
+	TYPE_GENERAL   = "general"
+	TYPE_LIST      = "list"
+	TYPE_DICT      = "dict"
+	TYPE_BITMAP    = "bitmap"
+	TYPE_GEO       = "geo"
+	TYPE_STREAM    = "stream"
+	GOROUTINE_ID   = "persist"
+	SCHEMAS_SUFFIX = "_schemas"
+	STAGING_SUFFIX = "_staging"
+	BULK_SIZE      = 1000
 )
 
 func NewMongoStorage(connectionString, dbName, collection string) *MongoStorage {
+	mongoStorage, _ := NewMongoStorageWithOptions(connectionString, dbName, collection, DefaultMongoOptions)
+	return mongoStorage
+}
+
+// NewMongoStorageWithOptions returns MongoDB storage with given connection settings.
+// Connection is established on first operation
+func NewMongoStorageWithOptions(connectionString, dbName, collection string, options MongoOptions) (*MongoStorage, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
 	mongoStorage := &MongoStorage{
 		connectionString: connectionString,
 		dbName:           dbName,
 		collection:       collection,
+		options:          options,
+		pool:             &mongoSession{},
 	}
-	return mongoStorage
+	return mongoStorage, nil
+}
+
+func init() {
+	RegisterBackend("mongodb", openMongoURL)
 }
 
+// openMongoURL creates MongoDB storage from mongodb://[user:password@]host[:port][,host...]/database/collection[?options].
+// Zero MongoDB options of backend mean DefaultMongoOptions
+func openMongoURL(rawURL string, options BackendOptions) (PersistStorage, error) {
+	address := rawURL[strings.Index(rawURL, ":")+1:]
+	if !strings.HasPrefix(address, "//") {
+		return nil, errors.New("MongoDB URL must start with mongodb://")
+	}
+	address, query := address[2:], ""
+	if i := strings.Index(address, "?"); i >= 0 {
+		address, query = address[:i], address[i:]
+	}
+	parts := strings.Split(address, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, errors.New("MongoDB URL must contain database and collection: mongodb://host/database/collection")
+	}
+	if options.Mongo == (MongoOptions{}) {
+		options.Mongo = DefaultMongoOptions
+	}
+	options.Mongo.Keyring = options.Keyring
+	options.Mongo.Compressor = options.Compressor
+	mongoStorage, err := NewMongoStorageWithOptions("mongodb://"+parts[0]+"/"+parts[1]+query, parts[1], parts[2], options.Mongo)
+	if err != nil {
+		return nil, err
+	}
+	return mongoStorage, nil
+}
+
+// SaveToDb writes snapshot to staging collection, verifies it and renames it over the live collection.
+// Failed save never destroys previous snapshot
 func (t MongoStorage) SaveToDb(storage *kvstorage.Storage) error {
-	session, err := t.getConnection(t.connectionString)
+	return t.SaveToDbContext(context.Background(), storage)
+}
+
+// SaveToDbContext is SaveToDb which can be cancelled before staging collection is renamed
+func (t MongoStorage) SaveToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	started := time.Now()
+	var saved manifest
+	changed, deleted := storage.TakeDirty()
+	err := t.withRetry(ctx, func(session *mgo.Session) error {
+		c := session.DB(t.dbName).C(t.collection + STAGING_SUFFIX)
+		if err := c.DropCollection(); err != nil && err.Error() != "ns not found" {
+			return err
+		}
+		if err := c.Create(&mgo.CollectionInfo{}); err != nil {
+			return err
+		}
+		if err := c.EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true}); err != nil {
+			return err
+		}
+		if err := c.EnsureIndex(mgo.Index{Key: []string{SHARD_FIELD}}); err != nil {
+			return err
+		}
+		var err error
+		if saved, err = t.saveSnapshot(ctx, c, storage); err != nil {
+			return err
+		}
+		if !t.options.KeepGenerations {
+			return t.replaceCollection(session, saved)
+		}
+		// Generation is copied before staging collection is renamed, but is listed only after the rename
+		// succeeds. Copy of failed save is dropped, so that it isn't left unlisted
+		generation, err := t.copyGeneration(c, saved)
+		if err != nil {
+			return err
+		}
+		err = t.replaceCollection(session, saved)
+		if err == nil {
+			err = t.recordGeneration(session, generation, saved)
+		}
+		if err != nil {
+			if dropErr := t.dropGeneration(session, generation.ID); dropErr != nil {
+				log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Can't drop copy of failed snapshot generation "+generation.ID, dropErr))
+			}
+		}
+		return err
+	})
 	if err != nil {
+		storage.RestoreDirty(changed, deleted)
 		return err
 	}
-	defer session.Close()
-	c := session.DB(t.dbName).C(t.collection)
-	if err := c.DropCollection(); err != nil && err.Error() != "ns not found" {
+	t.pool.measure("save", saved.Keys, started)
+	if t.options.KeepGenerations {
+		t.pruneGenerations(ctx)
+	}
+	return nil
+}
+
+// replaceCollection renames staging collection with saved snapshot over live one and saves its manifest
+func (t MongoStorage) replaceCollection(session *mgo.Session, saved manifest) error {
+	// Manifest of previous snapshot must not describe new one if rename succeeds but manifest is not saved
+	if err := t.removeManifest(session, t.collection); err != nil {
+		return err
+	}
+	if err := t.renameCollection(session, t.collection+STAGING_SUFFIX, t.collection); err != nil {
+		return err
+	}
+	saved.Collection = t.collection
+	return t.saveManifest(session, saved)
+}
+
+// saveSnapshot inserts all records to given collection by storage chunks in parallel and verifies their count.
+// Returns manifest of inserted records
+func (t MongoStorage) saveSnapshot(ctx context.Context, c *mgo.Collection, storage *kvstorage.Storage) (manifest, error) {
+	var inserted int64
+	hash := &contentHash{}
+	err := parallel(ctx, storage.Chunks(), t.options.Workers, func(ctx context.Context, shard int) error {
+		worker := c.Database.Session.Copy()
+		defer worker.Close()
+		count, err := t.insertShard(ctx, c.With(worker), storage, shard, hash)
+		atomic.AddInt64(&inserted, int64(count))
 		return err
+	})
+	if err != nil {
+		return manifest{}, err
+	}
+	stored, err := c.Count()
+	if err != nil {
+		return manifest{}, err
+	}
+	if stored != int(inserted) {
+		return manifest{}, errors.New("Snapshot verification failed: inserted " + strconv.FormatInt(inserted, 10) + " documents, found " + strconv.Itoa(stored))
+	}
+	return hash.manifest(c.Name), nil
+}
+
+// insertShard inserts records of storage chunk in bulks and adds them to hash. Returns number of inserted records
+func (t MongoStorage) insertShard(ctx context.Context, c *mgo.Collection, storage *kvstorage.Storage, shard int, hash *contentHash) (int, error) {
+	inserted := 0
+	count := 0
+	bulk := c.Bulk()
+	for _, key := range storage.ChunkKeys(shard) {
+		if err := keyDone(ctx); err != nil {
+			return inserted, err
+		}
+		value, ttl, ok := storage.GetWithTTL(key)
+		if !ok {
+			continue
+		}
+		document, err := t.document(key, value, ttl, shard)
+		if err != nil {
+			return inserted, err
+		}
+		record, err := rawRecord(document)
+		if err != nil {
+			return inserted, err
+		}
+		hash.add(record)
+		bulk.Insert(record)
+		count++
+		if count == t.options.BulkSize {
+			if _, err := bulk.Run(); err != nil {
+				return inserted, err
+			}
+			inserted += count
+			count = 0
+			bulk = c.Bulk()
+		}
+	}
+	if count > 0 {
+		if _, err := bulk.Run(); err != nil {
+			return inserted, err
+		}
+		inserted += count
+	}
+	return inserted, nil
+}
+
+// SaveChangesToDb upserts records changed and deletes records removed since previous save
+func (t MongoStorage) SaveChangesToDb(storage *kvstorage.Storage) error {
+	return t.SaveChangesToDbContext(context.Background(), storage)
+}
+
+// SaveChangesToDbContext is SaveChangesToDb which can be cancelled. Keys which are not saved stay changed
+func (t MongoStorage) SaveChangesToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	started := time.Now()
+	changed, deleted := storage.TakeDirty()
+	if err := t.saveKeys(ctx, storage, append(append([]string{}, changed...), deleted...)); err != nil {
+		storage.RestoreDirty(changed, deleted)
+		return err
+	}
+	log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_ID, "Saved "+strconv.Itoa(len(changed))+" changed and "+strconv.Itoa(len(deleted))+" deleted keys", nil))
+	t.pool.measure("save", int64(len(changed)+len(deleted)), started)
+	return nil
+}
+
+// SaveKeys upserts current state of keys. Absent keys are deleted
+func (t MongoStorage) SaveKeys(storage *kvstorage.Storage, keys []string) error {
+	return t.saveKeys(context.Background(), storage, keys)
+}
+
+// saveKeys upserts keys in bulks until context is cancelled. Keys of different storage chunks are written in parallel
+func (t MongoStorage) saveKeys(ctx context.Context, storage *kvstorage.Storage, keys []string) error {
+	shards := make([][]string, storage.Chunks())
+	for _, key := range keys {
+		shard := storage.ChunkIndex(key)
+		shards[shard] = append(shards[shard], key)
 	}
-	keys := storage.Keys()
-	count := 100
+	return t.withRetry(ctx, func(session *mgo.Session) error {
+		if err := t.removeManifest(session, t.collection); err != nil {
+			return err
+		}
+		return parallel(ctx, len(shards), t.options.Workers, func(ctx context.Context, shard int) error {
+			if len(shards[shard]) == 0 {
+				return nil
+			}
+			worker := session.Copy()
+			defer worker.Close()
+			return t.upsertKeys(ctx, worker.DB(t.dbName).C(t.collection), storage, shards[shard], shard)
+		})
+	})
+}
+
+// upsertKeys writes current state of keys of one storage chunk to collection. Upserts are idempotent,
+// so failed bulk can be repeated
+func (t MongoStorage) upsertKeys(ctx context.Context, c *mgo.Collection, storage *kvstorage.Storage, keys []string, shard int) error {
+	count := 0
 	bulk := c.Bulk()
+	bulk.Unordered()
 	for _, key := range keys {
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
 		if value, ttl, ok := storage.GetWithTTL(key); ok {
-			vType := TYPE_GENERAL
-			switch value.(type) {
-			case []interface{}:
-				vType = TYPE_LIST
-			case map[string]interface{}:
-				vType = TYPE_DICT
+			document, err := t.document(key, value, ttl, shard)
+			if err != nil {
+				return err
 			}
-			bulk.Insert(map[string]interface{}{"key": key, "value": value, "type": vType, "ttl": ttl})
-			count--
-			if count == 0 {
-				count = 100
-				if _, err := bulk.Run(); err != nil {
-					return err
-				}
-				bulk = c.Bulk()
+			bulk.Upsert(bson.M{"key": key}, document)
+		} else {
+			bulk.RemoveAll(bson.M{"key": key})
+		}
+		count++
+		if count == t.options.BulkSize {
+			count = 0
+			if _, err := bulk.Run(); err != nil {
+				return err
 			}
+			bulk = c.Bulk()
+			bulk.Unordered()
 		}
 	}
-	if count < 100 {
+	if count > 0 {
 		if _, err := bulk.Run(); err != nil {
 			return err
 		}
@@ -77,49 +333,307 @@ func (t MongoStorage) SaveToDb(storage *kvstorage.Storage) error {
 	return nil
 }
 
+// toDocument converts record to MongoDB document
+func toDocument(key string, value interface{}, ttl int64) map[string]interface{} {
+	vType := valueType(value)
+	switch v := value.(type) {
+	case []byte:
+	case *kvstorage.GeoSet:
+		value = geoToDocuments(v)
+	case *kvstorage.Stream:
+		value = streamToDocument(v)
+	default:
+		value = toBsonValue(value)
+	}
+	return map[string]interface{}{"key": key, "value": value, "type": vType, "ttl": ttl}
+}
+
+// renameCollection atomically replaces target collection with source one
+func (t MongoStorage) renameCollection(session *mgo.Session, source, target string) error {
+	return session.Run(bson.D{
+		{Name: "renameCollection", Value: t.dbName + "." + source},
+		{Name: "to", Value: t.dbName + "." + target},
+		{Name: "dropTarget", Value: true},
+	}, nil)
+}
+
+// mongoItem is stored record
+type mongoItem struct {
+	Key      string
+	Value    interface{}
+	TTL      int64
+	Type     string
+	Envelope envelope `bson:",inline"`
+	// Compressed means that envelope data is compressed
+	Compressed bool `bson:"z,omitempty"`
+}
+
+// decode converts stored value to storage value
+func (t mongoItem) decode() (interface{}, error) {
+	switch t.Type {
+	case TYPE_BITMAP:
+		return t.Value, nil
+	case TYPE_GEO:
+		return geoFromDocuments(t.Value), nil
+	case TYPE_STREAM:
+		return streamFromDocument(t.Value)
+	}
+	return fromBsonValue(t.Value)
+}
+
+// LoadKey returns value and TTL of one record
+func (t MongoStorage) LoadKey(key string) (interface{}, int64, bool, error) {
+	item := mongoItem{}
+	found := true
+	err := t.withRetry(context.Background(), func(session *mgo.Session) error {
+		err := session.DB(t.dbName).C(t.collection).Find(bson.M{"key": key}).One(&item)
+		if err == mgo.ErrNotFound {
+			found = false
+			return nil
+		}
+		return err
+	})
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	if err := t.unpack(&item); err != nil {
+		return nil, 0, false, err
+	}
+	value, err := item.decode()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return value, item.TTL, true, nil
+}
+
+// LoadFromDb loads all records which are not expired
 func (t MongoStorage) LoadFromDb(storage *kvstorage.Storage) error {
-	session, err := t.getConnection(t.connectionString)
+	return t.LoadFromDbContext(context.Background(), storage)
+}
+
+// LoadFromDbContext is LoadFromDb which can be cancelled. Cancelled load doesn't change storage
+func (t MongoStorage) LoadFromDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	return t.loadCollection(ctx, t.collection, storage)
+}
+
+// loadCollection loads records of collection by shards in parallel to separate storage and copies them
+// to given one. Collection saved at once is verified by its manifest before records are copied,
+// so that storage isn't changed by failed load
+func (t MongoStorage) loadCollection(ctx context.Context, collection string, storage *kvstorage.Storage) error {
+	started := time.Now()
+	var loaded int64
+	var expected *manifest
+	var hash *contentHash
+	var decoded *kvstorage.Storage
+	err := t.withRetry(ctx, func(session *mgo.Session) error {
+		loaded = 0
+		hash = &contentHash{}
+		decoded = kvstorage.NewKVStorage(uint32(storage.Chunks()), false)
+		var err error
+		if expected, err = t.loadManifest(session, collection); err != nil {
+			return err
+		}
+		filters := shardFilters(t.options.Workers)
+		return parallel(ctx, len(filters), t.options.Workers, func(ctx context.Context, i int) error {
+			worker := session.Copy()
+			defer worker.Close()
+			count, err := t.loadRecords(ctx, worker.DB(t.dbName).C(collection), filters[i], decoded, hash)
+			atomic.AddInt64(&loaded, int64(count))
+			return err
+		})
+	})
 	if err != nil {
 		return err
 	}
-	defer session.Close()
-	c := session.DB(t.dbName).C(t.collection)
-	iter := c.Find(bson.M{}).Iter()
-	item := struct {
-		Key   string
-		Value interface{}
-		TTL   int64
-		Type  string
-	}{}
+	if expected == nil {
+		// Manifest is removed by partial writes (incremental saves, write-through, write-behind, re-encryption)
+		log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_ID, "Loaded "+collection+" without manifest, records are not verified until next full save", nil))
+	} else if err := expected.verify(hash); err != nil {
+		log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_ID, "Refused to load "+collection, err))
+		return err
+	}
 	currentTime := time.Now().Unix()
-	for iter.Next(&item) {
-		if item.Type == TYPE_DICT {
-			if bM, ok := item.Value.(bson.M); ok {
-				tmpValue := map[string]interface{}{}
-				for bMKey := range bM {
-					tmpValue[bMKey] = bM[bMKey]
-				}
-				item.Value = tmpValue
-			}
+	for _, key := range decoded.Keys() {
+		value, ttl, ok := decoded.GetWithTTL(key)
+		if !ok || (ttl > 0 && ttl <= currentTime) {
+			continue
+		}
+		var duration time.Duration
+		if ttl > 0 {
+			duration = time.Unix(ttl, 0).Sub(time.Now())
+		}
+		storage.Set(key, value, duration)
+	}
+	storage.TakeDirty()
+	t.pool.measure("load", loaded, started)
+	return nil
+}
+
+// loadRecords copies records of collection matching filter to storage and adds them to hash. Load fails on
+// the first record which can't be decoded. Returns number of loaded records
+func (t MongoStorage) loadRecords(ctx context.Context, c *mgo.Collection, filter bson.M, storage *kvstorage.Storage, hash *contentHash) (int, error) {
+	iter := c.Find(filter).Iter()
+	raw := bson.Raw{}
+	loaded := 0
+	currentTime := time.Now().Unix()
+	for iter.Next(&raw) {
+		if err := keyDone(ctx); err != nil {
+			iter.Close()
+			return loaded, err
+		}
+		// Fields of previous record (e.g. encrypted value) must not stay in the next one
+		item := mongoItem{}
+		var record bson.RawD
+		err := raw.Unmarshal(&record)
+		if err == nil {
+			err = raw.Unmarshal(&item)
+		}
+		if err == nil {
+			err = t.unpack(&item)
+		}
+		var value interface{}
+		if err == nil {
+			value, err = item.decode()
 		}
+		if err != nil {
+			// Record which can't be decrypted or decoded would be lost on the next save
+			iter.Close()
+			return loaded, errors.New("Broken record with key " + item.Key + ": " + err.Error())
+		}
+		// Only decoded records are verified by manifest. Expired ones are hashed too because they were saved
+		hash.add(record)
+		item.Value = value
 		if currentTime < item.TTL || item.TTL == 0 {
 			var nsec time.Duration = 0
 			if item.TTL > 0 {
 				nsec = time.Duration(time.Unix(item.TTL, 0).Sub(time.Now()).Nanoseconds())
 			}
 			storage.Set(item.Key, item.Value, time.Nanosecond*nsec)
+			loaded++
 			log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_ID, "Loaded key: "+item.Key, nil))
 		} else {
 			log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_ID, "Skipped key: "+item.Key, nil))
 		}
 	}
-	return nil
+	// Cursor failure or broken reply stops iteration and is reported only on close
+	return loaded, iter.Close()
 }
 
-func (t MongoStorage) getConnection(connectionString string) (*mgo.Session, error) {
-	session, err := mgo.Dial(connectionString)
+// SaveSchemas replaces stored JSON Schemas
+func (t MongoStorage) SaveSchemas(schemas map[string]interface{}) error {
+	return t.withRetry(context.Background(), func(session *mgo.Session) error {
+		c := session.DB(t.dbName).C(t.collection + SCHEMAS_SUFFIX)
+		if _, err := c.RemoveAll(bson.M{}); err != nil {
+			return err
+		}
+		for prefix, schema := range schemas {
+			if err := c.Insert(bson.M{"prefix": prefix, "schema": schema}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadSchemas returns stored JSON Schemas by key prefix
+func (t MongoStorage) LoadSchemas() (map[string]interface{}, error) {
+	var schemas map[string]interface{}
+	err := t.withRetry(context.Background(), func(session *mgo.Session) error {
+		c := session.DB(t.dbName).C(t.collection + SCHEMAS_SUFFIX)
+		iter := c.Find(bson.M{}).Iter()
+		item := struct {
+			Prefix string
+			Schema interface{}
+		}{}
+		schemas = map[string]interface{}{}
+		for iter.Next(&item) {
+			schemas[item.Prefix] = fromBson(item.Schema)
+		}
+		return iter.Close()
+	})
 	if err != nil {
 		return nil, err
 	}
-	return session, nil
+	return schemas, nil
+}
+
+// fromBson converts nested bson documents to plain maps
+func fromBson(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		res := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			res[key] = fromBson(item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = fromBson(item)
+		}
+		return res
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return value
+}
+
+// geoToDocuments converts geo set to list of members
+func geoToDocuments(geoSet *kvstorage.GeoSet) []bson.M {
+	members := geoSet.Members()
+	documents := make([]bson.M, 0, len(members))
+	for _, member := range members {
+		documents = append(documents, bson.M{"name": member.Name, "lon": member.Longitude, "lat": member.Latitude})
+	}
+	return documents
+}
+
+// geoFromDocuments restores geo set from list of members
+func geoFromDocuments(value interface{}) *kvstorage.GeoSet {
+	geoSet := kvstorage.NewGeoSet()
+	if documents, ok := value.([]interface{}); ok {
+		for _, document := range documents {
+			if bM, ok := document.(bson.M); ok {
+				member := kvstorage.GeoMember{}
+				member.Name, _ = bM["name"].(string)
+				member.Longitude, _ = bM["lon"].(float64)
+				member.Latitude, _ = bM["lat"].(float64)
+				geoSet.Add(member)
+			}
+		}
+	}
+	return geoSet
+}
+
+// streamToDocument converts stream to its dump with entry fields converted to BSON
+func streamToDocument(stream *kvstorage.Stream) kvstorage.StreamDump {
+	dump := stream.Dump()
+	for i := range dump.Entries {
+		dump.Entries[i].Fields = toBsonValue(dump.Entries[i].Fields).(bson.M)
+	}
+	return dump
+}
+
+// streamFromDocument restores stream from its dump
+func streamFromDocument(value interface{}) (*kvstorage.Stream, error) {
+	raw, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var dump kvstorage.StreamDump
+	if err := bson.Unmarshal(raw, &dump); err != nil {
+		return nil, err
+	}
+	for i := range dump.Entries {
+		fields, err := fromBsonValue(dump.Entries[i].Fields)
+		if err != nil {
+			return nil, err
+		}
+		if dump.Entries[i].Fields, _ = fields.(map[string]interface{}); dump.Entries[i].Fields == nil {
+			return nil, errors.New("Broken fields of stream entry " + dump.Entries[i].ID)
+		}
+	}
+	return kvstorage.NewStreamFromDump(dump)
 }
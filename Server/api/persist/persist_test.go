@@ -0,0 +1,108 @@
+package persist
+
+import (
+	"encoding/json"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"testing"
+	"time"
+)
+
+// mongoRoundTrip stores record like MongoDB does (as BSON document) and reads it back
+func mongoRoundTrip(t *testing.T, key string, value interface{}, ttl int64) (interface{}, int64) {
+	raw, err := bson.Marshal(toDocument(key, value, ttl))
+	require.NoError(t, err)
+	item := mongoItem{}
+	require.NoError(t, bson.Unmarshal(raw, &item))
+	require.Equal(t, key, item.Key)
+	loaded, err := item.decode()
+	require.NoError(t, err)
+	return loaded, item.TTL
+}
+
+func TestMongoValueRoundTrip(t *testing.T) {
+	values := []interface{}{
+		nil,
+		true,
+		"string",
+		1.0,
+		1.5,
+		42,
+		math.MaxInt64,
+		int64(42),
+		int64(math.MinInt64),
+		json.Number("12345678901234567890123"),
+		[]interface{}{},
+		map[string]interface{}{},
+		[]interface{}{1, 2.0, nil, []interface{}{map[string]interface{}{"a": int64(1), "b": []interface{}{json.Number("0.10000000000000000001")}}}},
+		map[string]interface{}{
+			"list":        []interface{}{map[string]interface{}{"nested": map[string]interface{}{"x": 1}}},
+			"null":        nil,
+			"float":       2.0,
+			"int":         2,
+			bsonTypeField: "user value",
+		},
+		map[string]interface{}{"escaped": map[string]interface{}{bsonTypeField: bsonTypeInt64, bsonValueField: "x"}},
+	}
+	for _, value := range values {
+		loaded, ttl := mongoRoundTrip(t, "key", value, 123)
+		require.Equal(t, value, loaded)
+		require.Equal(t, int64(123), ttl)
+	}
+}
+
+func TestMongoNumbers(t *testing.T) {
+	// Numbers written through HTTP API are stored as native BSON numbers unless they would lose precision
+	numbers := []struct {
+		number json.Number
+		stored interface{}
+		loaded interface{}
+	}{
+		{"7", int64(7), 7},
+		{"-9223372036854775808", int64(math.MinInt64), math.MinInt64},
+		{"1.0", 1.0, 1.0},
+		{"0.1", 0.1, 0.1},
+		{"-1.5e3", -1500.0, -1500.0},
+		{"12345678901234567890123", bson.M{bsonTypeField: bsonTypeNumber, bsonValueField: "12345678901234567890123"}, json.Number("12345678901234567890123")},
+		{"0.10000000000000000001", bson.M{bsonTypeField: bsonTypeNumber, bsonValueField: "0.10000000000000000001"}, json.Number("0.10000000000000000001")},
+		{"1e400", bson.M{bsonTypeField: bsonTypeNumber, bsonValueField: "1e400"}, json.Number("1e400")},
+	}
+	for _, number := range numbers {
+		require.Equal(t, number.stored, toBsonValue(number.number), string(number.number))
+		loaded, _ := mongoRoundTrip(t, "key", []interface{}{number.number}, 0)
+		require.Equal(t, []interface{}{number.loaded}, loaded, string(number.number))
+	}
+}
+
+func TestMongoBrokenValue(t *testing.T) {
+	item := mongoItem{Key: "key", Type: TYPE_GENERAL, Value: bson.M{bsonTypeField: bsonTypeNumber, bsonValueField: 1.0}}
+	_, err := item.decode()
+	require.Error(t, err)
+}
+
+func TestMongoStorageRoundTrip(t *testing.T) {
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	fields := map[string]interface{}{"n": int64(1), "d": map[string]interface{}{"i": 1}, bsonTypeField: json.Number("1e400")}
+	_, err := storage.XAdd("fields", "1-1", fields, 0)
+	require.NoError(t, err)
+
+	loaded := kvstorage.NewKVStorage(4, false)
+	for _, key := range storage.Keys() {
+		value, ttl, ok := storage.GetWithTTL(key)
+		require.True(t, ok)
+		value, ttl = mongoRoundTrip(t, key, value, ttl)
+		var duration time.Duration
+		if ttl > 0 {
+			duration = time.Unix(ttl, 0).Sub(time.Now())
+		}
+		loaded.Set(key, value, duration)
+	}
+	checkStorageNumber(t, loaded, 1)
+	entries, err := loaded.XRange("fields", kvstorage.StreamIDFirst, kvstorage.StreamIDLast, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, fields, entries[0].Fields)
+}
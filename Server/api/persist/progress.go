@@ -0,0 +1,46 @@
+package persist
+
+import (
+	"context"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"sync/atomic"
+)
+
+// JobStorage is persistent storage which reports progress of saving and loading to context
+// (see WithProgress) and stops when context is cancelled
+type JobStorage interface {
+	SaveToDbContext(context.Context, *kvstorage.Storage) error
+	SaveChangesToDbContext(context.Context, *kvstorage.Storage) error
+	LoadFromDbContext(context.Context, *kvstorage.Storage) error
+}
+
+// Progress is number of keys processed by save or load
+type Progress struct {
+	processed int64
+}
+
+type progressKey struct{}
+
+// WithProgress returns context which counts keys processed by JobStorage
+func WithProgress(ctx context.Context) (context.Context, *Progress) {
+	progress := &Progress{}
+	return context.WithValue(ctx, progressKey{}, progress), progress
+}
+
+// Processed returns number of processed keys
+func (t *Progress) Processed() int64 {
+	return atomic.LoadInt64(&t.processed)
+}
+
+// Add counts processed keys
+func (t *Progress) Add(keys int) {
+	atomic.AddInt64(&t.processed, int64(keys))
+}
+
+// keyDone counts processed key. Returns error if context is cancelled
+func keyDone(ctx context.Context) error {
+	if progress, ok := ctx.Value(progressKey{}).(*Progress); ok {
+		progress.Add(1)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,95 @@
+package persist
+
+import (
+	"errors"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BackendOptions are settings of persistent storage which are not given in its URL
+type BackendOptions struct {
+	// Mongo are connection settings of MongoDB storage, zero value means DefaultMongoOptions. Keyring and
+	// compressor are taken from backend options
+	Mongo MongoOptions
+	// AOFFsync is fsync policy of append only file if it is not given in URL
+	AOFFsync string
+	// Keyring encrypts values. Nil disables encryption
+	Keyring *Keyring
+	// Compressor compresses large values. Nil disables compression
+	Compressor *kvstorage.Compressor
+}
+
+// Backend creates persistent storage from URL. URL is given as is because some schemes (e.g. MongoDB one
+// with several hosts) are not valid for url.Parse
+type Backend func(rawURL string, options BackendOptions) (PersistStorage, error)
+
+// backends are registered backends by URL scheme
+var backends = struct {
+	sync.RWMutex
+	byScheme map[string]Backend
+}{byScheme: map[string]Backend{}}
+
+// RegisterBackend makes persistent storage available by URL scheme. It panics if scheme is already registered
+func RegisterBackend(scheme string, backend Backend) {
+	backends.Lock()
+	defer backends.Unlock()
+	if _, ok := backends.byScheme[scheme]; ok {
+		panic("Persistent storage is already registered for scheme " + scheme)
+	}
+	backends.byScheme[scheme] = backend
+}
+
+// Backends returns registered URL schemes in alphabetical order
+func Backends() []string {
+	backends.RLock()
+	defer backends.RUnlock()
+	schemes := make([]string, 0, len(backends.byScheme))
+	for scheme := range backends.byScheme {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenURL creates persistent storage registered for scheme of URL
+func OpenURL(rawURL string, options BackendOptions) (PersistStorage, error) {
+	scheme := ""
+	if i := strings.Index(rawURL, ":"); i > 0 {
+		scheme = strings.ToLower(rawURL[:i])
+	}
+	backends.RLock()
+	backend, ok := backends.byScheme[scheme]
+	backends.RUnlock()
+	if !ok {
+		return nil, errors.New("Unknown persistent storage: " + rawURL)
+	}
+	return backend(rawURL, options)
+}
+
+// parseFileURL returns path of file given in URL and URL query. Both file:///absolute/path and
+// file:relative/path are accepted
+func parseFileURL(rawURL string) (string, url.Values, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return "", nil, errors.New("Path is required for " + u.Scheme + " persistent storage")
+	}
+	return path, u.Query(), nil
+}
+
+// unencrypted checks that encryption is not requested from storage which doesn't support it
+func (t BackendOptions) unencrypted(rawURL string) error {
+	if t.Keyring != nil {
+		return errors.New("Encryption is not supported by persistent storage " + rawURL)
+	}
+	return nil
+}
@@ -0,0 +1,724 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"hash"
+	"hash/crc64"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Snapshot file is magic, version, records and end marker followed by CRC-64 (ECMA) of all preceding bytes.
+// Record is key, value type, value and TTL (unix time, 0 means no TTL). Encrypted record is key, ID of master key,
+// wrapped data key, encrypted value type and value, and TTL
+const (
+	SNAPSHOT_MAGIC   = "KVSNAP"
+	SNAPSHOT_VERSION = 1
+)
+
+const (
+	snapshotOpKey    = 1
+	snapshotOpSealed = 2
+	snapshotOpEOF    = 0xFF
+)
+
+// Tags of values in snapshot
+const (
+	snapshotTagNil = iota
+	snapshotTagFalse
+	snapshotTagTrue
+	snapshotTagNumber
+	snapshotTagString
+	snapshotTagList
+	snapshotTagMap
+	snapshotTagInt
+	snapshotTagInt64
+	snapshotTagJSONNumber
+)
+
+// Codes of stored value types in snapshot
+const (
+	snapshotTypeGeneral = iota
+	snapshotTypeList
+	snapshotTypeDict
+	snapshotTypeBitmap
+	snapshotTypeGeo
+	snapshotTypeStream
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// SnapshotStorage saves point-in-time binary snapshots of storage to local file
+type SnapshotStorage struct {
+	sync.Mutex
+	path    string
+	keyring *Keyring
+}
+
+func init() {
+	RegisterBackend("file", openSnapshotURL)
+}
+
+// openSnapshotURL creates snapshot storage given as file:///path/to/file. Values are encrypted with keyring
+// of backend options
+func openSnapshotURL(rawURL string, options BackendOptions) (PersistStorage, error) {
+	path, _, err := parseFileURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := NewSnapshotStorage(path)
+	snapshot.SetKeyring(options.Keyring)
+	return snapshot, nil
+}
+
+// NewSnapshotStorage creates snapshot storage which keeps snapshot in given file
+func NewSnapshotStorage(path string) *SnapshotStorage {
+	return &SnapshotStorage{path: path}
+}
+
+// SetKeyring makes storage encrypt values it writes. Must be called before storage is used
+func (t *SnapshotStorage) SetKeyring(keyring *Keyring) {
+	t.keyring = keyring
+}
+
+// SaveToDb writes snapshot of all keys to temporary file and renames it over previous snapshot
+func (t *SnapshotStorage) SaveToDb(storage *kvstorage.Storage) error {
+	return t.SaveToDbContext(context.Background(), storage)
+}
+
+// SaveToDbContext is SaveToDb which can be cancelled. Cancelled save keeps previous snapshot
+func (t *SnapshotStorage) SaveToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	t.Lock()
+	defer t.Unlock()
+	changed, deleted := storage.TakeDirty()
+	count := 0
+	err := writeFileAtomic(t.path, func(writer io.Writer) error {
+		var err error
+		count, err = writeSnapshot(ctx, writer, storage, t.keyring)
+		return err
+	})
+	if err != nil {
+		storage.RestoreDirty(changed, deleted)
+		return err
+	}
+	log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_ID, "Saved snapshot with "+strconv.Itoa(count)+" keys", nil))
+	return nil
+}
+
+// SaveChangesToDb saves full snapshot because snapshot file can't be updated partially
+func (t *SnapshotStorage) SaveChangesToDb(storage *kvstorage.Storage) error {
+	return t.SaveToDb(storage)
+}
+
+// SaveChangesToDbContext saves full snapshot like SaveToDbContext
+func (t *SnapshotStorage) SaveChangesToDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	return t.SaveToDbContext(ctx, storage)
+}
+
+// LoadFromDb verifies checksum of snapshot and loads it to storage
+func (t *SnapshotStorage) LoadFromDb(storage *kvstorage.Storage) error {
+	return t.LoadFromDbContext(context.Background(), storage)
+}
+
+// LoadFromDbContext is LoadFromDb which can be cancelled. Keys loaded before cancellation stay in storage
+func (t *SnapshotStorage) LoadFromDbContext(ctx context.Context, storage *kvstorage.Storage) error {
+	t.Lock()
+	defer t.Unlock()
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := verifySnapshot(file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	count, err := readSnapshot(ctx, file, storage, t.keyring)
+	if err != nil {
+		return err
+	}
+	storage.TakeDirty()
+	log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_ID, "Loaded snapshot with "+strconv.Itoa(count)+" keys", nil))
+	return nil
+}
+
+// SaveSchemas replaces JSON Schemas stored next to snapshot
+func (t *SnapshotStorage) SaveSchemas(schemas map[string]interface{}) error {
+	return saveSchemasFile(t.path+SCHEMAS_FILE_SUFFIX, schemas)
+}
+
+// LoadSchemas returns JSON Schemas stored next to snapshot
+func (t *SnapshotStorage) LoadSchemas() (map[string]interface{}, error) {
+	return loadSchemasFile(t.path + SCHEMAS_FILE_SUFFIX)
+}
+
+// Encrypted reports whether values are encrypted
+func (t *SnapshotStorage) Encrypted() bool {
+	return t.keyring != nil
+}
+
+// Reencrypt rewrites snapshot file with plain records encrypted and data keys of records encrypted with old keys
+// wrapped with current key. Cancelled re-encryption keeps previous file. Returns number of rewritten records
+func (t *SnapshotStorage) Reencrypt(ctx context.Context) (int, error) {
+	if t.keyring == nil {
+		return 0, errors.New("Encryption keys are not configured")
+	}
+	t.Lock()
+	defer t.Unlock()
+	file, err := os.Open(t.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if err := verifySnapshot(file); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	err = writeFileAtomic(t.path, func(writer io.Writer) error {
+		w := newSnapshotWriter(writer)
+		w.writeHeader()
+		err := readRecords(ctx, file, func(record snapshotRecord) error {
+			switch {
+			case record.sealed == nil:
+				w.writeRecord(record.key, record.value, record.ttl, t.keyring)
+				rewritten++
+			case record.sealed.KeyID != t.keyring.CurrentID():
+				rewrapped, err := t.keyring.rewrap(*record.sealed)
+				if err != nil {
+					return errors.New("Can't re-encrypt key " + record.key + ": " + err.Error())
+				}
+				w.writeSealed(record.key, rewrapped, record.ttl)
+				rewritten++
+			default:
+				w.writeSealed(record.key, *record.sealed, record.ttl)
+			}
+			return w.err
+		})
+		if err != nil {
+			return err
+		}
+		return w.finish()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rewritten, nil
+}
+
+// verifySnapshot checks that file ends with valid checksum
+func verifySnapshot(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(len(SNAPSHOT_MAGIC)+2+1+8) {
+		return errors.New("Snapshot is too short")
+	}
+	crc := crc64.New(crcTable)
+	if _, err := io.CopyN(crc, file, info.Size()-8); err != nil {
+		return err
+	}
+	var sum [8]byte
+	if _, err := io.ReadFull(file, sum[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(sum[:]) != crc.Sum64() {
+		return errors.New("Snapshot checksum mismatch")
+	}
+	return nil
+}
+
+// WriteSnapshot writes all keys of storage in snapshot format. Returns number of written keys
+func WriteSnapshot(writer io.Writer, storage *kvstorage.Storage) (int, error) {
+	return writeSnapshot(context.Background(), writer, storage, nil)
+}
+
+// writeSnapshot writes snapshot until context is cancelled. Values are encrypted if keyring is given
+func writeSnapshot(ctx context.Context, writer io.Writer, storage *kvstorage.Storage, keyring *Keyring) (int, error) {
+	w := newSnapshotWriter(writer)
+	w.writeHeader()
+	count := 0
+	for _, key := range storage.Keys() {
+		if err := keyDone(ctx); err != nil {
+			return count, err
+		}
+		value, ttl, ok := storage.GetWithTTL(key)
+		if !ok {
+			continue
+		}
+		w.writeRecord(key, value, ttl, keyring)
+		if w.err != nil {
+			return count, w.err
+		}
+		count++
+	}
+	return count, w.finish()
+}
+
+// ReadSnapshot loads keys from snapshot to storage. Expired keys are skipped. Returns number of loaded keys.
+// Checksum is not verified
+func ReadSnapshot(reader io.Reader, storage *kvstorage.Storage) (int, error) {
+	return readSnapshot(context.Background(), reader, storage, nil)
+}
+
+// readSnapshot loads snapshot until context is cancelled. Encrypted values are decrypted with keyring
+func readSnapshot(ctx context.Context, reader io.Reader, storage *kvstorage.Storage, keyring *Keyring) (int, error) {
+	currentTime := time.Now().Unix()
+	count := 0
+	err := readRecords(ctx, reader, func(record snapshotRecord) error {
+		if record.ttl > 0 && record.ttl <= currentTime {
+			return nil
+		}
+		value := record.value
+		if record.sealed != nil {
+			var err error
+			if value, err = openValue(keyring, record); err != nil {
+				return errors.New("Broken record with key " + record.key + ": " + err.Error())
+			}
+		}
+		var duration time.Duration
+		if record.ttl > 0 {
+			duration = time.Unix(record.ttl, 0).Sub(time.Now())
+		}
+		storage.Set(record.key, value, duration)
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// snapshotRecord is record of snapshot. Value of encrypted record is not decrypted
+type snapshotRecord struct {
+	key    string
+	value  interface{}
+	sealed *envelope
+	ttl    int64
+}
+
+// openValue decrypts value of encrypted record
+func openValue(keyring *Keyring, record snapshotRecord) (interface{}, error) {
+	if keyring == nil {
+		return nil, errors.New("Record is encrypted, but encryption keys are not configured")
+	}
+	plaintext, err := keyring.open(*record.sealed, record.key)
+	if err != nil {
+		return nil, err
+	}
+	r := &snapshotReader{r: bufio.NewReader(bytes.NewReader(plaintext))}
+	value := r.readTyped()
+	return value, r.err
+}
+
+// readRecords checks header of snapshot and passes its records to apply until end marker or context cancellation
+func readRecords(ctx context.Context, reader io.Reader, apply func(snapshotRecord) error) error {
+	r := &snapshotReader{r: bufio.NewReader(reader)}
+	magic := make([]byte, len(SNAPSHOT_MAGIC))
+	r.read(magic)
+	if r.err == nil && string(magic) != SNAPSHOT_MAGIC {
+		return errors.New("Not a snapshot file")
+	}
+	version := make([]byte, 2)
+	r.read(version)
+	if r.err == nil && binary.BigEndian.Uint16(version) != SNAPSHOT_VERSION {
+		return errors.New("Unsupported snapshot version " + strconv.Itoa(int(binary.BigEndian.Uint16(version))))
+	}
+	for r.err == nil {
+		op := r.readByte()
+		if r.err != nil {
+			break
+		}
+		if op == snapshotOpEOF {
+			return nil
+		}
+		if op != snapshotOpKey && op != snapshotOpSealed {
+			return errors.New("Broken snapshot: unknown record")
+		}
+		if err := keyDone(ctx); err != nil {
+			return err
+		}
+		record := snapshotRecord{key: r.readString()}
+		if op == snapshotOpKey {
+			record.value = r.readTyped()
+		} else {
+			record.sealed = &envelope{KeyID: r.readString(), DataKey: r.readBytes(), Data: r.readBytes()}
+		}
+		record.ttl = r.readVarint()
+		if r.err != nil {
+			break
+		}
+		if err := apply(record); err != nil {
+			return err
+		}
+	}
+	return r.err
+}
+
+// snapshotWriter encodes snapshot and calculates its checksum. First error stops writing
+type snapshotWriter struct {
+	w   io.Writer
+	out io.Writer
+	crc hash.Hash64
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func newSnapshotWriter(writer io.Writer) *snapshotWriter {
+	crc := crc64.New(crcTable)
+	return &snapshotWriter{w: io.MultiWriter(writer, crc), out: writer, crc: crc}
+}
+
+// writeHeader writes magic and version of snapshot
+func (t *snapshotWriter) writeHeader() {
+	t.write([]byte(SNAPSHOT_MAGIC))
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, SNAPSHOT_VERSION)
+	t.write(version)
+}
+
+// writeRecord writes key with its value and TTL. Value is encrypted if keyring is given
+func (t *snapshotWriter) writeRecord(key string, value interface{}, ttl int64, keyring *Keyring) {
+	if keyring == nil {
+		t.write([]byte{snapshotOpKey})
+		t.writeString(key)
+		t.writeTyped(value)
+		t.writeVarint(ttl)
+		return
+	}
+	typed := &bytes.Buffer{}
+	w := newSnapshotWriter(typed)
+	w.writeTyped(value)
+	if w.err != nil {
+		t.fail(w.err)
+		return
+	}
+	sealed, err := keyring.seal(typed.Bytes(), key)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	t.writeSealed(key, sealed, ttl)
+}
+
+// writeSealed writes key with its encrypted value and TTL
+func (t *snapshotWriter) writeSealed(key string, sealed envelope, ttl int64) {
+	t.write([]byte{snapshotOpSealed})
+	t.writeString(key)
+	t.writeString(sealed.KeyID)
+	t.writeString(string(sealed.DataKey))
+	t.writeString(string(sealed.Data))
+	t.writeVarint(ttl)
+}
+
+// finish writes end marker and checksum
+func (t *snapshotWriter) finish() error {
+	t.write([]byte{snapshotOpEOF})
+	if t.err != nil {
+		return t.err
+	}
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], t.crc.Sum64())
+	_, t.err = t.out.Write(sum[:])
+	return t.err
+}
+
+// fail remembers the first error
+func (t *snapshotWriter) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *snapshotWriter) write(data []byte) {
+	if t.err == nil {
+		_, t.err = t.w.Write(data)
+	}
+}
+
+func (t *snapshotWriter) writeUvarint(value uint64) {
+	t.write(t.buf[:binary.PutUvarint(t.buf[:], value)])
+}
+
+func (t *snapshotWriter) writeVarint(value int64) {
+	t.write(t.buf[:binary.PutVarint(t.buf[:], value)])
+}
+
+func (t *snapshotWriter) writeFloat(value float64) {
+	binary.BigEndian.PutUint64(t.buf[:8], math.Float64bits(value))
+	t.write(t.buf[:8])
+}
+
+func (t *snapshotWriter) writeString(value string) {
+	t.writeUvarint(uint64(len(value)))
+	t.write([]byte(value))
+}
+
+// writeTyped writes type code and value of stored record
+func (t *snapshotWriter) writeTyped(value interface{}) {
+	switch v := value.(type) {
+	case []byte:
+		t.write([]byte{snapshotTypeBitmap})
+		t.writeUvarint(uint64(len(v)))
+		t.write(v)
+	case *kvstorage.GeoSet:
+		t.write([]byte{snapshotTypeGeo})
+		members := v.Members()
+		t.writeUvarint(uint64(len(members)))
+		for _, member := range members {
+			t.writeString(member.Name)
+			t.writeFloat(member.Longitude)
+			t.writeFloat(member.Latitude)
+		}
+	case *kvstorage.Stream:
+		t.write([]byte{snapshotTypeStream})
+		t.writeStream(v.Dump())
+	case []interface{}:
+		t.write([]byte{snapshotTypeList})
+		t.writeValue(v)
+	case map[string]interface{}:
+		t.write([]byte{snapshotTypeDict})
+		t.writeValue(v)
+	default:
+		t.write([]byte{snapshotTypeGeneral})
+		t.writeValue(v)
+	}
+}
+
+func (t *snapshotWriter) writeStream(dump kvstorage.StreamDump) {
+	t.writeString(dump.LastID)
+	t.writeUvarint(uint64(len(dump.Entries)))
+	for _, entry := range dump.Entries {
+		t.writeString(entry.ID)
+		t.writeValue(entry.Fields)
+	}
+	t.writeUvarint(uint64(len(dump.Groups)))
+	for _, group := range dump.Groups {
+		t.writeString(group.Name)
+		t.writeString(group.LastDelivered)
+		t.writeUvarint(uint64(len(group.Pending)))
+		for _, pending := range group.Pending {
+			t.writeString(pending.ID)
+			t.writeString(pending.Consumer)
+			t.writeVarint(pending.DeliveredAt)
+			t.writeVarint(int64(pending.Deliveries))
+		}
+	}
+}
+
+// writeValue writes JSON-like value
+func (t *snapshotWriter) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		t.write([]byte{snapshotTagNil})
+	case bool:
+		if v {
+			t.write([]byte{snapshotTagTrue})
+		} else {
+			t.write([]byte{snapshotTagFalse})
+		}
+	case float64:
+		t.write([]byte{snapshotTagNumber})
+		t.writeFloat(v)
+	case int:
+		t.write([]byte{snapshotTagInt})
+		t.writeVarint(int64(v))
+	case int64:
+		t.write([]byte{snapshotTagInt64})
+		t.writeVarint(v)
+	case json.Number:
+		t.write([]byte{snapshotTagJSONNumber})
+		t.writeString(string(v))
+	case string:
+		t.write([]byte{snapshotTagString})
+		t.writeString(v)
+	case []interface{}:
+		t.write([]byte{snapshotTagList})
+		t.writeUvarint(uint64(len(v)))
+		for _, item := range v {
+			t.writeValue(item)
+		}
+	case map[string]interface{}:
+		t.write([]byte{snapshotTagMap})
+		t.writeUvarint(uint64(len(v)))
+		for key, item := range v {
+			t.writeString(key)
+			t.writeValue(item)
+		}
+	default:
+		if t.err == nil {
+			t.err = errors.New("Can't write value of unsupported type to snapshot")
+		}
+	}
+}
+
+// snapshotReader decodes snapshot. First error stops reading
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (t *snapshotReader) read(data []byte) {
+	if t.err == nil {
+		_, t.err = io.ReadFull(t.r, data)
+	}
+}
+
+func (t *snapshotReader) readByte() byte {
+	var b [1]byte
+	t.read(b[:])
+	return b[0]
+}
+
+func (t *snapshotReader) readUvarint() uint64 {
+	if t.err != nil {
+		return 0
+	}
+	var value uint64
+	value, t.err = binary.ReadUvarint(t.r)
+	return value
+}
+
+func (t *snapshotReader) readVarint() int64 {
+	if t.err != nil {
+		return 0
+	}
+	var value int64
+	value, t.err = binary.ReadVarint(t.r)
+	return value
+}
+
+func (t *snapshotReader) readFloat() float64 {
+	var b [8]byte
+	t.read(b[:])
+	return math.Float64frombits(binary.BigEndian.Uint64(b[:]))
+}
+
+func (t *snapshotReader) readBytes() []byte {
+	length := t.readUvarint()
+	if t.err != nil {
+		return nil
+	}
+	data := make([]byte, length)
+	t.read(data)
+	return data
+}
+
+func (t *snapshotReader) readString() string {
+	return string(t.readBytes())
+}
+
+// readTyped reads type code and value of stored record
+func (t *snapshotReader) readTyped() interface{} {
+	code := t.readByte()
+	if t.err != nil {
+		return nil
+	}
+	switch code {
+	case snapshotTypeGeneral, snapshotTypeList, snapshotTypeDict:
+		return t.readValue()
+	case snapshotTypeBitmap:
+		return t.readBytes()
+	case snapshotTypeGeo:
+		count := t.readUvarint()
+		geoSet := kvstorage.NewGeoSet()
+		for i := uint64(0); i < count && t.err == nil; i++ {
+			member := kvstorage.GeoMember{Name: t.readString()}
+			member.Longitude = t.readFloat()
+			member.Latitude = t.readFloat()
+			geoSet.Add(member)
+		}
+		return geoSet
+	case snapshotTypeStream:
+		dump := t.readStream()
+		if t.err != nil {
+			return nil
+		}
+		var stream *kvstorage.Stream
+		stream, t.err = kvstorage.NewStreamFromDump(dump)
+		return stream
+	}
+	t.err = errors.New("Broken snapshot: unknown value type")
+	return nil
+}
+
+func (t *snapshotReader) readStream() kvstorage.StreamDump {
+	dump := kvstorage.StreamDump{LastID: t.readString()}
+	count := t.readUvarint()
+	for i := uint64(0); i < count && t.err == nil; i++ {
+		entry := kvstorage.StreamEntry{ID: t.readString()}
+		entry.Fields, _ = t.readValue().(map[string]interface{})
+		dump.Entries = append(dump.Entries, entry)
+	}
+	count = t.readUvarint()
+	for i := uint64(0); i < count && t.err == nil; i++ {
+		group := kvstorage.StreamGroupDump{Name: t.readString(), LastDelivered: t.readString()}
+		pendingCount := t.readUvarint()
+		for j := uint64(0); j < pendingCount && t.err == nil; j++ {
+			pending := kvstorage.PendingEntry{ID: t.readString(), Consumer: t.readString()}
+			pending.DeliveredAt = t.readVarint()
+			pending.Deliveries = int(t.readVarint())
+			group.Pending = append(group.Pending, pending)
+		}
+		dump.Groups = append(dump.Groups, group)
+	}
+	return dump
+}
+
+// readValue reads JSON-like value
+func (t *snapshotReader) readValue() interface{} {
+	tag := t.readByte()
+	if t.err != nil {
+		return nil
+	}
+	switch tag {
+	case snapshotTagNil:
+		return nil
+	case snapshotTagFalse:
+		return false
+	case snapshotTagTrue:
+		return true
+	case snapshotTagNumber:
+		return t.readFloat()
+	case snapshotTagString:
+		return t.readString()
+	case snapshotTagInt:
+		return int(t.readVarint())
+	case snapshotTagInt64:
+		return t.readVarint()
+	case snapshotTagJSONNumber:
+		return json.Number(t.readString())
+	case snapshotTagList:
+		count := t.readUvarint()
+		list := []interface{}{}
+		for i := uint64(0); i < count && t.err == nil; i++ {
+			list = append(list, t.readValue())
+		}
+		return list
+	case snapshotTagMap:
+		count := t.readUvarint()
+		dict := map[string]interface{}{}
+		for i := uint64(0); i < count && t.err == nil; i++ {
+			key := t.readString()
+			dict[key] = t.readValue()
+		}
+		return dict
+	}
+	t.err = errors.New("Broken snapshot: unknown value tag")
+	return nil
+}
@@ -0,0 +1,108 @@
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	snapshot := NewSnapshotStorage(path)
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	require.NoError(t, snapshot.SaveToDb(storage))
+	require.Equal(t, 0, storage.DirtyCount())
+	_, err := os.Stat(path + TMP_FILE_SUFFIX)
+	require.True(t, os.IsNotExist(err))
+
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, snapshot.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+	require.Equal(t, 0, loaded.DirtyCount())
+}
+
+func TestSnapshotNumbers(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	snapshot := NewSnapshotStorage(path)
+	numbers := []interface{}{1.5, 2, int64(1) << 60, json.Number("12345678901234567890")}
+	storage := kvstorage.NewKVStorage(4, false)
+	storage.Set("numbers", numbers, 0)
+	require.NoError(t, snapshot.SaveToDb(storage))
+
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, snapshot.LoadFromDb(loaded))
+	value, _ := loaded.Get("numbers")
+	require.Equal(t, numbers, value)
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	snapshot := NewSnapshotStorage(path)
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	require.NoError(t, snapshot.SaveToDb(storage))
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	raw[len(SNAPSHOT_MAGIC)+5] ^= 0xFF
+	require.NoError(t, ioutil.WriteFile(path, raw, 0644))
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.EqualError(t, snapshot.LoadFromDb(loaded), "Snapshot checksum mismatch")
+	require.Empty(t, loaded.Keys())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("KVSNAP"), 0644))
+	require.EqualError(t, snapshot.LoadFromDb(loaded), "Snapshot is too short")
+}
+
+func TestSnapshotEncryption(t *testing.T) {
+	path, cleanup := newTestFile(t)
+	defer cleanup()
+	snapshot := NewSnapshotStorage(path)
+	storage := kvstorage.NewKVStorage(4, false)
+	fillStorage(t, storage)
+	require.NoError(t, snapshot.SaveToDb(storage))
+	keyring, err := NewKeyring("k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	snapshot.SetKeyring(keyring)
+	require.True(t, snapshot.Encrypted())
+
+	// Plain snapshot is readable and is encrypted by re-encryption
+	count, err := snapshot.Reencrypt(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(storage.Keys()), count)
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "value")
+	require.NotContains(t, string(raw), "Rome")
+	loaded := kvstorage.NewKVStorage(4, false)
+	require.NoError(t, snapshot.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+
+	// Values are still readable after key rotation and are re-encrypted with new key
+	rotated, err := NewKeyring("k2:" + testKey(2, 32) + ",k1:" + testKey(1, 32))
+	require.NoError(t, err)
+	snapshot.SetKeyring(rotated)
+	count, err = snapshot.Reencrypt(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(storage.Keys()), count)
+	count, err = snapshot.Reencrypt(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	newKeys, err := NewKeyring("k2:" + testKey(2, 32))
+	require.NoError(t, err)
+	snapshot.SetKeyring(newKeys)
+	loaded = kvstorage.NewKVStorage(4, false)
+	require.NoError(t, snapshot.LoadFromDb(loaded))
+	checkStorage(t, loaded)
+
+	snapshot.SetKeyring(nil)
+	require.Error(t, snapshot.LoadFromDb(kvstorage.NewKVStorage(4, false)))
+}
@@ -0,0 +1,374 @@
+package api
+
+import (
+	"bytes"
+	"github.com/Labutin/KVServer/Server/api/persist"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Persistence modes
+const (
+	PERSIST_MODE_SNAPSHOT      = "snapshot"
+	PERSIST_MODE_WRITE_THROUGH = "write-through"
+	PERSIST_MODE_WRITE_BEHIND  = "write-behind"
+)
+
+const PERSIST_GOROUTINE_NAME = "persistMode"
+
+// persistModeStatus is state of write-through and write-behind persistence
+type persistModeStatus struct {
+	Mode          string    `json:"mode"`
+	Queued        int       `json:"queued"`
+	QueueSize     int       `json:"queueSize"`
+	BatchSize     int       `json:"batchSize"`
+	FlushInterval string    `json:"flushInterval"`
+	Written       int64     `json:"written"`
+	Failures      int64     `json:"failures"`
+	LastFlush     time.Time `json:"lastFlush"`
+	LastError     string    `json:"lastError"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+}
+
+// persistMode writes changed keys to persistent storage after request which changed them (write-through)
+// or in batches from background worker (write-behind). Storage only remembers changed keys, so persistent
+// storage is never called while storage locks are held
+type persistMode struct {
+	sync.Mutex
+	status     persistModeStatus
+	storage    *kvstorage.Storage
+	attached   bool
+	listenerID int
+	unsaved    map[string]bool
+	writing    int
+	queueSize  int
+	batchSize  int
+	space      *sync.Cond
+	stopped    bool
+	writeMutex sync.Mutex
+	wakeup     chan struct{}
+	flushes    chan chan error
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+var writes = newPersistMode()
+
+// newPersistMode creates persistence in snapshot mode
+func newPersistMode() *persistMode {
+	t := &persistMode{status: persistModeStatus{Mode: PERSIST_MODE_SNAPSHOT}, unsaved: map[string]bool{}}
+	t.space = sync.NewCond(&t.Mutex)
+	return t
+}
+
+// StartPersistMode starts writing changed keys to persistent storage. In write-behind mode keys are written
+// in batches of batchSize keys at least every flushInterval. Writers block when queueSize keys are waiting
+// for write
+func StartPersistMode(mode string, queueSize, batchSize int, flushInterval time.Duration) error {
+	if mode == PERSIST_MODE_SNAPSHOT {
+		return nil
+	}
+	if mode != PERSIST_MODE_WRITE_THROUGH && mode != PERSIST_MODE_WRITE_BEHIND {
+		return UnknownPersistMode
+	}
+	if _, ok := persistStorage.(persist.KeyWriter); !ok {
+		return PersistModeNotSupported
+	}
+	if queueSize <= 0 || batchSize <= 0 || flushInterval <= 0 {
+		return InvalidPersistModeOptions
+	}
+	writes.Lock()
+	if writes.done != nil {
+		writes.Unlock()
+		return PersistModeStarted
+	}
+	writes.status = persistModeStatus{
+		Mode:          mode,
+		QueueSize:     queueSize,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval.String(),
+	}
+	done := make(chan struct{})
+	writes.unsaved = map[string]bool{}
+	writes.queueSize = queueSize
+	writes.batchSize = batchSize
+	writes.stopped = false
+	writes.wakeup = make(chan struct{}, 1)
+	writes.flushes = make(chan chan error)
+	writes.done = done
+	writes.Unlock()
+	writes.attach(getStorage())
+	if mode == PERSIST_MODE_WRITE_BEHIND {
+		writes.wg.Add(1)
+		go writes.loop(done, flushInterval)
+	}
+	log.Println(logs.MakeLogString(logs.INFO, PERSIST_GOROUTINE_NAME, "Persistence mode "+mode+" started", nil))
+	return nil
+}
+
+// StopPersistMode stops writing changed keys. Keys waiting for write are written before return
+func StopPersistMode() {
+	writes.Lock()
+	done := writes.done
+	mode := writes.status.Mode
+	writes.done = nil
+	// Writers waiting for full queue are released before listener is removed
+	writes.stopped = true
+	writes.space.Broadcast()
+	writes.Unlock()
+	if done == nil {
+		return
+	}
+	writes.detach()
+	close(done)
+	writes.wg.Wait()
+	if mode == PERSIST_MODE_WRITE_THROUGH {
+		writes.writeUnsaved()
+	}
+	writes.Lock()
+	if len(writes.unsaved) > 0 {
+		log.Println(logs.MakeLogString(logs.ERROR, PERSIST_GOROUTINE_NAME, strconv.Itoa(len(writes.unsaved))+" keys were not written on shutdown", nil))
+	}
+	writes.unsaved = map[string]bool{}
+	writes.status.Mode = PERSIST_MODE_SNAPSHOT
+	writes.Unlock()
+}
+
+// attach starts following changes of storage. Previously attached storage is detached
+func (t *persistMode) attach(storage *kvstorage.Storage) {
+	t.detach()
+	t.Lock()
+	defer t.Unlock()
+	if t.status.Mode == PERSIST_MODE_SNAPSHOT || t.done == nil || storage == nil {
+		return
+	}
+	t.storage = storage
+	t.attached = true
+	t.listenerID = storage.AddChangeListener(func(key string, changed bool) {
+		// Keys loaded from persistent storage are not written back
+		if IsReady() {
+			t.changed(key)
+		}
+	})
+}
+
+// detach stops following changes of attached storage. Storage is kept for writing of remembered keys
+func (t *persistMode) detach() {
+	t.Lock()
+	attached := t.attached
+	t.attached = false
+	storage := t.storage
+	listenerID := t.listenerID
+	t.Unlock()
+	if attached {
+		storage.RemoveChangeListener(listenerID)
+	}
+}
+
+// changed remembers changed key. It is called by storage, so it must not block
+func (t *persistMode) changed(key string) {
+	t.Lock()
+	t.unsaved[key] = true
+	batchReady := t.status.Mode == PERSIST_MODE_WRITE_BEHIND && len(t.unsaved) >= t.batchSize
+	wakeup := t.wakeup
+	t.Unlock()
+	if batchReady {
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// afterWrite is called when request (or load) which changed storage is finished and storage locks are
+// released. In write-through mode changed keys are written now, in write-behind mode caller waits while
+// queueSize keys are waiting for write
+func (t *persistMode) afterWrite() error {
+	t.Lock()
+	mode := t.status.Mode
+	if mode == PERSIST_MODE_WRITE_BEHIND {
+		for !t.stopped && len(t.unsaved)+t.writing >= t.queueSize {
+			t.space.Wait()
+		}
+	}
+	t.Unlock()
+	if mode == PERSIST_MODE_WRITE_THROUGH {
+		return t.writeUnsaved()
+	}
+	return nil
+}
+
+// sync writes all changed keys and returns the first error. In write-behind mode keys are written by worker
+func (t *persistMode) sync() error {
+	t.Lock()
+	mode := t.status.Mode
+	flushes := t.flushes
+	done := t.done
+	t.Unlock()
+	if mode != PERSIST_MODE_WRITE_BEHIND || done == nil {
+		return t.writeUnsaved()
+	}
+	reply := make(chan error, 1)
+	select {
+	case flushes <- reply:
+		return <-reply
+	case <-done:
+		return nil
+	}
+}
+
+// writeUnsaved writes remembered keys in batches. Keys which are not written are remembered again.
+// Writes are serialized, so older state of key never overwrites newer one
+func (t *persistMode) writeUnsaved() error {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	t.Lock()
+	keys := make([]string, 0, len(t.unsaved))
+	for key := range t.unsaved {
+		keys = append(keys, key)
+	}
+	t.unsaved = map[string]bool{}
+	t.writing = len(keys)
+	batchSize := t.batchSize
+	storage := t.storage
+	t.Unlock()
+	sort.Strings(keys)
+	var err error
+	for len(keys) > 0 && err == nil {
+		batch := keys
+		if batchSize > 0 && len(batch) > batchSize {
+			batch = keys[:batchSize]
+		}
+		if err = t.write(storage, batch); err == nil {
+			keys = keys[len(batch):]
+		}
+		t.Lock()
+		t.writing = len(keys)
+		t.space.Broadcast()
+		t.Unlock()
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, key := range keys {
+		t.unsaved[key] = true
+	}
+	t.writing = 0
+	t.space.Broadcast()
+	return err
+}
+
+// write saves keys to persistent storage and updates status
+func (t *persistMode) write(storage *kvstorage.Storage, keys []string) error {
+	err := persistStorage.(persist.KeyWriter).SaveKeys(storage, keys)
+	t.Lock()
+	defer t.Unlock()
+	if err != nil {
+		t.status.Failures++
+		t.status.LastError = err.Error()
+		t.status.LastErrorTime = time.Now()
+		log.Println(logs.MakeLogString(logs.ERROR, PERSIST_GOROUTINE_NAME, "Can't write "+strconv.Itoa(len(keys))+" keys", err))
+		return err
+	}
+	t.status.Written += int64(len(keys))
+	t.status.LastFlush = time.Now()
+	return nil
+}
+
+// loop writes changed keys when batch is collected, on flush interval and on request.
+// Failed keys are retried on next flush
+func (t *persistMode) loop(done chan struct{}, flushInterval time.Duration) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	t.Lock()
+	wakeup := t.wakeup
+	flushes := t.flushes
+	t.Unlock()
+	for {
+		select {
+		case <-wakeup:
+			t.writeUnsaved()
+		case <-ticker.C:
+			t.writeUnsaved()
+		case reply := <-flushes:
+			reply <- t.writeUnsaved()
+		case <-done:
+			t.writeUnsaved()
+			return
+		}
+	}
+}
+
+// getStatus returns copy of current status
+func (t *persistMode) getStatus() persistModeStatus {
+	t.Lock()
+	defer t.Unlock()
+	status := t.status
+	status.Queued = len(t.unsaved) + t.writing
+	return status
+}
+
+// writeChanges is middleware which writes keys changed by modifying request to persistent storage in
+// write-through mode before response is sent. Response is replaced by error if keys can't be written.
+// In write-behind mode request is finished when there is space in queue
+func writeChanges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if writes.getStatus().Mode != PERSIST_MODE_WRITE_THROUGH {
+			next.ServeHTTP(w, r)
+			writes.afterWrite()
+			return
+		}
+		bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+		if err := writes.afterWrite(); err != nil && bw.status < http.StatusBadRequest {
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+		bw.writeTo(w)
+	})
+}
+
+// bufferedWriter keeps response until changed keys are written
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (t *bufferedWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *bufferedWriter) Write(data []byte) (int, error) {
+	return t.body.Write(data)
+}
+
+func (t *bufferedWriter) WriteHeader(status int) {
+	t.status = status
+}
+
+// writeTo sends kept response
+func (t *bufferedWriter) writeTo(w http.ResponseWriter) {
+	for name, values := range t.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(t.status)
+	w.Write(t.body.Bytes())
+}
+
+// getPersistModeStatus returns persistence mode and write-behind queue state
+func getPersistModeStatus(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, Resp{Response: writes.getStatus(), Ok: true})
+}
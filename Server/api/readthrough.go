@@ -0,0 +1,72 @@
+package api
+
+import (
+	"github.com/Labutin/KVServer/Server/api/persist"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"log"
+	"sync"
+	"time"
+)
+
+// readThrough is configuration of loading keys absent in memory from persistent storage
+type readThrough struct {
+	sync.Mutex
+	enabled bool
+	ttl     time.Duration
+}
+
+var cache = &readThrough{}
+
+// StartReadThrough makes storage load absent keys from persistent storage and keep them for ttl
+// (0 means until their own expiration). Concurrent misses of the same key load it once
+func StartReadThrough(ttl time.Duration) error {
+	if _, ok := persistStorage.(persist.KeyLoader); !ok {
+		return ReadThroughNotSupported
+	}
+	cache.Lock()
+	cache.enabled = true
+	cache.ttl = ttl
+	cache.Unlock()
+	cache.attach(getStorage())
+	trackChanges(getStorage())
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Read-through started with TTL "+ttl.String(), nil))
+	return nil
+}
+
+// StopReadThrough stops loading absent keys
+func StopReadThrough() {
+	cache.Lock()
+	cache.enabled = false
+	cache.Unlock()
+	cache.attach(getStorage())
+	trackChanges(getStorage())
+}
+
+// isEnabled reports whether absent keys are loaded from persistent storage
+func (t *readThrough) isEnabled() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.enabled
+}
+
+// attach sets miss loader of storage according to configuration
+func (t *readThrough) attach(storage *kvstorage.Storage) {
+	if storage == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if !t.enabled {
+		storage.SetMissLoader(nil, 0)
+		return
+	}
+	loader := persistStorage.(persist.KeyLoader)
+	storage.SetMissLoader(func(key string) (interface{}, int64, bool, error) {
+		value, ttl, found, err := loader.LoadKey(key)
+		if err != nil {
+			log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_NAME, "Can't load key: "+key, err))
+		}
+		return value, ttl, found, err
+	}, t.ttl)
+}
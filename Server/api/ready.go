@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/api/persist"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// ready is 1 when storage is ready to serve requests
+var ready int32 = 1
+
+// SetReady marks storage as ready or not ready to serve requests
+func SetReady(isReady bool) {
+	if isReady {
+		atomic.StoreInt32(&ready, 1)
+	} else {
+		atomic.StoreInt32(&ready, 0)
+	}
+}
+
+// IsReady reports whether storage is ready to serve requests
+func IsReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// held is 1 while automatic saves are suspended
+var held int32
+
+// LoadOnStart restores data and schemas from persistent storage and marks storage as ready on success.
+// Data is loaded to separate storage which replaces current one only on success. If data can't be loaded,
+// automatic saves are suspended, so that empty storage doesn't overwrite persistent data
+func LoadOnStart() error {
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Loading data from persistent storage", nil))
+	if err := restore(context.Background(), LOAD_MODE_REPLACE, "", persistLoad); err != nil {
+		if err != LoadInProgress {
+			holdPersisted(true)
+		}
+		return err
+	}
+	if err := LoadSchemas(); err != nil {
+		return err
+	}
+	SetReady(true)
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Data loaded from persistent storage", nil))
+	return nil
+}
+
+// holdPersisted suspends (or resumes) autosave and background compaction of persistent storage.
+// Explicit save or load resumes them
+func holdPersisted(hold bool) {
+	if hold {
+		if atomic.SwapInt32(&held, 1) == 0 {
+			log.Println(logs.MakeLogString(logs.WARN, GOROUTINE_NAME, "Automatic saves are suspended until data is loaded or saved explicitly", nil))
+		}
+	} else if atomic.SwapInt32(&held, 0) == 1 {
+		log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Automatic saves are resumed", nil))
+	}
+	if compactor, ok := persistStorage.(persist.AutoCompactor); ok {
+		compactor.SetAutoCompaction(!hold)
+	}
+}
+
+// isPersistedHeld reports whether automatic saves are suspended
+func isPersistedHeld() bool {
+	return atomic.LoadInt32(&held) == 1
+}
+
+// handlerReady returns 503 status until data is loaded
+func handlerReady(w http.ResponseWriter, r *http.Request) {
+	if !IsReady() {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, Resp{Error: NotReady.String(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: "ready", Ok: true})
+}
+
+// requireReady is middleware which rejects requests until data is loaded
+func requireReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsReady() {
+			render.Status(r, http.StatusServiceUnavailable)
+			render.JSON(w, r, Resp{Error: NotReady.String(), Ok: false})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getPersistHealth returns state of connection to persistent storage. Storages which don't check
+// connection are always healthy. Returns 503 status if storage is unavailable
+func getPersistHealth(w http.ResponseWriter, r *http.Request) {
+	checker, ok := persistStorage.(persist.HealthChecker)
+	if !ok {
+		render.JSON(w, r, Resp{Response: persist.Health{Healthy: true}, Ok: true})
+		return
+	}
+	health := checker.Health()
+	if !health.Healthy {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, Resp{Response: health, Error: PersistUnhealthy.String(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: health, Ok: true})
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"github.com/Labutin/KVServer/Server/api/schema"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var schemas = schema.NewRegistry()
+
+// schemaUpdates serializes changes of schemas, so every change is saved together with previous ones
+var schemaUpdates sync.Mutex
+
+// invalidValue is error of value which doesn't match schema registered for its key
+type invalidValue struct {
+	key  string
+	errs []schema.ValidationError
+}
+
+func (t invalidValue) Error() string {
+	return ValidationFailed.String() + " for key: " + t.key
+}
+
+// checkValue returns invalidValue error if value doesn't match schema registered for key prefix
+func checkValue(key string, value interface{}) error {
+	if errs := schemas.Validate(key, value); len(errs) > 0 {
+		return invalidValue{key: key, errs: errs}
+	}
+	return nil
+}
+
+// checkLoaded checks values of loaded keys with prefix before they are applied to current storage
+func checkLoaded(loaded *kvstorage.Storage, prefix string) error {
+	for _, key := range loaded.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if value, ok := loaded.Get(key); ok {
+			if err := checkValue(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadSchemas restores registered JSON Schemas from persistent storage
+func LoadSchemas() error {
+	loaded, err := persistStorage.LoadSchemas()
+	if err != nil {
+		return err
+	}
+	return schemas.Replace(loaded)
+}
+
+// validateValue checks value against schema registered for key prefix.
+// Writes validation errors to response and returns false if value is invalid
+func validateValue(w http.ResponseWriter, r *http.Request, key string, value interface{}) bool {
+	err := checkValue(key, value)
+	if err == nil {
+		return true
+	}
+	renderInvalidValue(w, r, err.(invalidValue))
+	return false
+}
+
+// renderInvalidValue writes validation errors of value to response
+func renderInvalidValue(w http.ResponseWriter, r *http.Request, err invalidValue) {
+	log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_NAME, "Rejected invalid value with key: "+err.key, nil))
+	render.Status(r, http.StatusUnprocessableEntity)
+	render.JSON(w, r, Resp{Response: err.errs, Error: ValidationFailed.String(), Ok: false})
+}
+
+// getSchemas returns all registered schemas by key prefix
+func getSchemas(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, Resp{Response: schemas.All(), Ok: true})
+}
+
+// addSchema saves all schemas with JSON Schema for key prefix to persistent storage and registers it.
+// Schema is not used if it can't be saved
+func addSchema(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Prefix string      `json:"prefix"`
+		Schema interface{} `json:"schema"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	schemaUpdates.Lock()
+	defer schemaUpdates.Unlock()
+	updated, err := schemas.With(data.Prefix, data.Schema)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	if !saveSchemas(w, r, updated) {
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Registered schema for prefix: "+data.Prefix, nil))
+	render.JSON(w, r, Resp{Response: "", Ok: true})
+}
+
+// removeSchema saves all schemas except of JSON Schema for key prefix to persistent storage and removes it
+func removeSchema(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Prefix string `json:"prefix"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	schemaUpdates.Lock()
+	defer schemaUpdates.Unlock()
+	updated := schemas.All()
+	if _, ok := updated[data.Prefix]; !ok {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: SchemaNotFound.String(), Ok: false})
+		return
+	}
+	delete(updated, data.Prefix)
+	if !saveSchemas(w, r, updated) {
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Removed schema for prefix: "+data.Prefix, nil))
+	render.JSON(w, r, Resp{Response: "", Ok: true})
+}
+
+// saveSchemas saves schemas to persistent storage and then makes them current.
+// Writes error to response and returns false if schemas can't be saved
+func saveSchemas(w http.ResponseWriter, r *http.Request, updated map[string]interface{}) bool {
+	if err := persistStorage.SaveSchemas(updated); err != nil {
+		log.Println(logs.MakeLogString(logs.ERROR, GOROUTINE_NAME, "Can't save schemas", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return false
+	}
+	if err := schemas.Replace(updated); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return false
+	}
+	return true
+}
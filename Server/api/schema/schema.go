@@ -0,0 +1,346 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ValidationError describes one place where value doesn't match schema
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Registry keeps JSON Schemas for key prefixes
+type Registry struct {
+	sync.RWMutex
+	schemas map[string]map[string]interface{}
+}
+
+// NewRegistry creates empty schema registry
+func NewRegistry() *Registry {
+	return &Registry{schemas: map[string]map[string]interface{}{}}
+}
+
+// Set registers schema for given key prefix
+func (t *Registry) Set(prefix string, schema interface{}) error {
+	schemaMap, ok := schema.(map[string]interface{})
+	if !ok {
+		return errors.New("Schema must be an object")
+	}
+	if err := check(schemaMap); err != nil {
+		return err
+	}
+	t.Lock()
+	t.schemas[prefix] = schemaMap
+	t.Unlock()
+	return nil
+}
+
+// With returns all registered schemas and given schema for key prefix. Registry is not changed, so schemas
+// can be saved before they are used
+func (t *Registry) With(prefix string, schema interface{}) (map[string]interface{}, error) {
+	schemaMap, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Schema must be an object")
+	}
+	if err := check(schemaMap); err != nil {
+		return nil, err
+	}
+	res := t.All()
+	res[prefix] = schemaMap
+	return res, nil
+}
+
+// Remove deletes schema for given key prefix
+func (t *Registry) Remove(prefix string) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.schemas[prefix]
+	delete(t.schemas, prefix)
+	return ok
+}
+
+// All returns all registered schemas by prefix
+func (t *Registry) All() map[string]interface{} {
+	t.RLock()
+	defer t.RUnlock()
+	res := make(map[string]interface{}, len(t.schemas))
+	for prefix, schema := range t.schemas {
+		res[prefix] = schema
+	}
+	return res
+}
+
+// Replace swaps all registered schemas. Invalid schemas are rejected as a whole
+func (t *Registry) Replace(schemas map[string]interface{}) error {
+	newSchemas := make(map[string]map[string]interface{}, len(schemas))
+	for prefix, schema := range schemas {
+		schemaMap, ok := schema.(map[string]interface{})
+		if !ok {
+			return errors.New("Schema for prefix " + prefix + " must be an object")
+		}
+		if err := check(schemaMap); err != nil {
+			return err
+		}
+		newSchemas[prefix] = schemaMap
+	}
+	t.Lock()
+	t.schemas = newSchemas
+	t.Unlock()
+	return nil
+}
+
+// Match returns schema with the longest prefix matching key
+func (t *Registry) Match(key string) (map[string]interface{}, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	best := ""
+	var res map[string]interface{}
+	for prefix, schema := range t.schemas {
+		if strings.HasPrefix(key, prefix) && (res == nil || len(prefix) > len(best)) {
+			best = prefix
+			res = schema
+		}
+	}
+	return res, res != nil
+}
+
+// Validate checks value for given key against matching schema
+func (t *Registry) Validate(key string, value interface{}) []ValidationError {
+	schema, ok := t.Match(key)
+	if !ok {
+		return nil
+	}
+	return Validate(schema, value)
+}
+
+// check verifies that schema keywords have correct types
+func check(schema map[string]interface{}) error {
+	if pattern, ok := schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	if properties, ok := schema["properties"]; ok {
+		propertiesMap, ok := properties.(map[string]interface{})
+		if !ok {
+			return errors.New("properties must be an object")
+		}
+		for name, property := range propertiesMap {
+			propertyMap, ok := property.(map[string]interface{})
+			if !ok {
+				return errors.New("Schema of property " + name + " must be an object")
+			}
+			if err := check(propertyMap); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"items", "additionalProperties"} {
+		if sub, ok := schema[keyword].(map[string]interface{}); ok {
+			if err := check(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks value against JSON Schema. Supported keywords: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minimum, maximum, minLength, maxLength, pattern
+func Validate(schema map[string]interface{}, value interface{}) []ValidationError {
+	errs := []ValidationError{}
+	validate(schema, value, "$", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// typeOf returns JSON Schema type name of decoded JSON value
+func typeOf(value interface{}) string {
+	if number, ok := toNumber(value); ok {
+		if number == math.Trunc(number) {
+			return "integer"
+		}
+		return "number"
+	}
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// toNumber returns value of number decoded as float64, json.Number or stored as integer
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// equal compares JSON values. Numbers are equal if they have the same value whatever their types are
+func equal(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	switch v := a.(type) {
+	case []interface{}:
+		list, ok := b.([]interface{})
+		if !ok || len(list) != len(v) {
+			return false
+		}
+		for i := range v {
+			if !equal(v[i], list[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		dict, ok := b.(map[string]interface{})
+		if !ok || len(dict) != len(v) {
+			return false
+		}
+		for key, item := range v {
+			if other, ok := dict[key]; !ok || !equal(item, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// typeMatches checks value type against 'type' keyword which is string or list of strings
+func typeMatches(expected interface{}, actual string) bool {
+	types := []interface{}{expected}
+	if list, ok := expected.([]interface{}); ok {
+		types = list
+	}
+	for _, t := range types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func validate(schema map[string]interface{}, value interface{}, path string, errs *[]ValidationError) {
+	addError := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	actualType := typeOf(value)
+	if expected, ok := schema["type"]; ok && !typeMatches(expected, actualType) {
+		addError("expected type %v, got %s", expected, actualType)
+		return
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, item := range enum {
+			if equal(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			addError("value is not one of %v", enum)
+		}
+	}
+	if constValue, ok := schema["const"]; ok && !equal(constValue, value) {
+		addError("value must be %v", constValue)
+	}
+	if number, ok := toNumber(value); ok {
+		if minimum, ok := toNumber(schema["minimum"]); ok && number < minimum {
+			addError("value must be >= %v", minimum)
+		}
+		if maximum, ok := toNumber(schema["maximum"]); ok && number > maximum {
+			addError("value must be <= %v", maximum)
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if minLength, ok := toNumber(schema["minLength"]); ok && length < minLength {
+			addError("length must be >= %v", minLength)
+		}
+		if maxLength, ok := toNumber(schema["maxLength"]); ok && length > maxLength {
+			addError("length must be <= %v", maxLength)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				addError("value must match pattern %s", pattern)
+			}
+		}
+	case []interface{}:
+		length := float64(len(v))
+		if minItems, ok := toNumber(schema["minItems"]); ok && length < minItems {
+			addError("number of items must be >= %v", minItems)
+		}
+		if maxItems, ok := toNumber(schema["maxItems"]); ok && length > maxItems {
+			addError("number of items must be <= %v", maxItems)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				validate(items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if nameStr, ok := name.(string); ok {
+					if _, ok := v[nameStr]; !ok {
+						addError("property %s is required", nameStr)
+					}
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propertyPath := path + "." + name
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				validate(property, v[name], propertyPath, errs)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					*errs = append(*errs, ValidationError{Path: propertyPath, Message: "additional property is not allowed"})
+				}
+			case map[string]interface{}:
+				validate(additional, v[name], propertyPath, errs)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package schema
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestTypeOf(t *testing.T) {
+	require.Equal(t, "null", typeOf(nil))
+	require.Equal(t, "boolean", typeOf(true))
+	require.Equal(t, "integer", typeOf(3.0))
+	require.Equal(t, "number", typeOf(3.5))
+	require.Equal(t, "integer", typeOf(json.Number("3")))
+	require.Equal(t, "number", typeOf(json.Number("3.5")))
+	require.Equal(t, "integer", typeOf(3))
+	require.Equal(t, "integer", typeOf(int64(3)))
+	require.Equal(t, "string", typeOf("s"))
+	require.Equal(t, "array", typeOf([]interface{}{1.0}))
+	require.Equal(t, "object", typeOf(map[string]interface{}{}))
+	require.Equal(t, "unknown", typeOf([]byte{1}))
+}
+
+func TestValidate(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"name", "tags"},
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string", "minLength": 2.0, "maxLength": 4.0, "pattern": "^[A-Z]"},
+			"age":  map[string]interface{}{"type": "integer", "minimum": 0.0, "maximum": 150.0},
+			"tags": map[string]interface{}{
+				"type":     "array",
+				"minItems": 1.0,
+				"maxItems": 2.0,
+				"items":    map[string]interface{}{"enum": []interface{}{"a", "b"}},
+			},
+			"kind": map[string]interface{}{"const": "user"},
+		},
+		"additionalProperties": map[string]interface{}{"type": []interface{}{"number", "null"}},
+	}
+	require.Nil(t, Validate(schema, map[string]interface{}{
+		"name": "Ann",
+		"age":  30.0,
+		"tags": []interface{}{"a"},
+		"kind": "user",
+		"x":    1.5,
+		"y":    nil,
+	}))
+
+	require.Equal(t, []ValidationError{{Path: "$", Message: "expected type object, got array"}},
+		Validate(schema, []interface{}{}))
+	require.Equal(t, []ValidationError{
+		{Path: "$", Message: "property name is required"},
+		{Path: "$", Message: "property tags is required"},
+	}, Validate(schema, map[string]interface{}{}))
+	require.Equal(t, []ValidationError{
+		{Path: "$.age", Message: "value must be <= 150"},
+		{Path: "$.kind", Message: "value must be user"},
+		{Path: "$.name", Message: "length must be <= 4"},
+		{Path: "$.name", Message: "value must match pattern ^[A-Z]"},
+		{Path: "$.tags", Message: "number of items must be <= 2"},
+		{Path: "$.tags[2]", Message: "value is not one of [a b]"},
+		{Path: "$.x", Message: "expected type [number null], got string"},
+	}, Validate(schema, map[string]interface{}{
+		"name": "annie",
+		"age":  151.0,
+		"tags": []interface{}{"a", "b", "c"},
+		"kind": "admin",
+		"x":    "s",
+	}))
+	require.Equal(t, []ValidationError{
+		{Path: "$.age", Message: "expected type integer, got number"},
+		{Path: "$.name", Message: "length must be >= 2"},
+		{Path: "$.tags", Message: "number of items must be >= 1"},
+	}, Validate(schema, map[string]interface{}{
+		"name": "A",
+		"age":  1.5,
+		"tags": []interface{}{},
+	}))
+
+	require.Nil(t, Validate(schema, map[string]interface{}{
+		"name": "Ann",
+		"age":  json.Number("30"),
+		"tags": []interface{}{"a"},
+	}))
+	require.Equal(t, []ValidationError{{Path: "$.age", Message: "value must be <= 150"}},
+		Validate(schema, map[string]interface{}{"name": "Ann", "age": int64(151), "tags": []interface{}{"b"}}))
+	require.Nil(t, Validate(map[string]interface{}{"enum": []interface{}{[]interface{}{1.0}}}, []interface{}{json.Number("1")}))
+
+	// Numeric keywords may be json.Number (HTTP) or integers (persistent storage)
+	numbers := map[string]interface{}{"minimum": json.Number("1"), "maximum": int64(3), "minLength": json.Number("2"), "maxItems": 1}
+	require.Nil(t, Validate(numbers, json.Number("2")))
+	require.Equal(t, []ValidationError{{Path: "$", Message: "value must be <= 3"}}, Validate(numbers, 4.0))
+	require.Equal(t, []ValidationError{{Path: "$", Message: "value must be >= 1"}}, Validate(numbers, json.Number("0")))
+	require.Equal(t, []ValidationError{{Path: "$", Message: "length must be >= 2"}}, Validate(numbers, "a"))
+	require.Equal(t, []ValidationError{{Path: "$", Message: "number of items must be <= 1"}}, Validate(numbers, []interface{}{1.0, 2.0}))
+
+	closed := map[string]interface{}{"additionalProperties": false}
+	require.Equal(t, []ValidationError{{Path: "$.a", Message: "additional property is not allowed"}},
+		Validate(closed, map[string]interface{}{"a": 1.0}))
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	require.Error(t, registry.Set("a", "not object"))
+	require.Error(t, registry.Set("a", map[string]interface{}{"pattern": "("}))
+	require.NoError(t, registry.Set("a", map[string]interface{}{"type": "string"}))
+	require.NoError(t, registry.Set("ab", map[string]interface{}{"type": "number"}))
+	require.Nil(t, registry.Validate("abc", 1.0))
+	require.Nil(t, registry.Validate("b", 1.0))
+	require.Len(t, registry.Validate("a1", 1.0), 1)
+
+	updated, err := registry.With("c", map[string]interface{}{"type": "null"})
+	require.NoError(t, err)
+	require.Len(t, updated, 3)
+	_, ok := registry.Match("c")
+	require.False(t, ok)
+	_, err = registry.With("c", map[string]interface{}{"properties": "x"})
+	require.Error(t, err)
+
+	require.True(t, registry.Remove("a"))
+	require.False(t, registry.Remove("a"))
+	require.NoError(t, registry.Replace(updated))
+	require.Len(t, registry.All(), 3)
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"context"
+	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
+	"github.com/pressly/chi"
+	"github.com/pressly/chi/render"
+	"log"
+	"net/http"
+	"time"
+)
+
+// addStreamEntry appends entry to stream. ID is generated if absent or '*'
+func addStreamEntry(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key    string                 `json:"key"`
+		ID     string                 `json:"id"`
+		Fields map[string]interface{} `json:"fields"`
+		MaxLen int                    `json:"maxlen"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	id, err := getStorage().XAdd(data.Key, data.ID, data.Fields, data.MaxLen)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.DEBUG, GOROUTINE_NAME, "Added stream entry "+id+" with key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: id, Ok: true})
+}
+
+// getStreamRange returns entries with IDs between 'start' and 'end' query parameters
+func getStreamRange(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	start := r.URL.Query().Get("start")
+	if start == "" {
+		start = kvstorage.StreamIDFirst
+	}
+	end := r.URL.Query().Get("end")
+	if end == "" {
+		end = kvstorage.StreamIDLast
+	}
+	count, err := queryInt(r, "count", 0)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	entries, err := getStorage().XRange(key, start, end, count)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: entries, Ok: true})
+}
+
+// readStream returns entries after ID from 'after' query parameter ('$' by default).
+// 'block' query parameter is time in milliseconds to wait for new entries
+func readStream(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	after := r.URL.Query().Get("after")
+	if after == "" {
+		after = kvstorage.StreamIDNew
+	}
+	count, err := queryInt(r, "count", 0)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	block, err := queryInt(r, "block", 0)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	if after == kvstorage.StreamIDNew {
+		// ID is taken once, so that entries added to storage which replaces current one are read too
+		if after, err = getStorage().XLastID(key); err != nil {
+			render.Status(r, http.StatusNotAcceptable)
+			render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+			return
+		}
+	}
+	entries, err := readBlocking(r, time.Millisecond*time.Duration(block), func(storage *kvstorage.Storage) ([]kvstorage.StreamEntry, error) {
+		return storage.XRead(context.Background(), key, after, count, 0)
+	})
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: entries, Ok: true})
+}
+
+// trimStream removes oldest entries by length and/or age (in seconds)
+func trimStream(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key    string `json:"key"`
+		MaxLen int    `json:"maxlen"`
+		MaxAge int64  `json:"maxage"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	removed, err := getStorage().XTrim(data.Key, data.MaxLen, time.Second*time.Duration(data.MaxAge))
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Trimmed stream with key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: removed, Ok: true})
+}
+
+// addStreamGroup creates consumer group. 'start' is ID to read after, '$' by default
+func addStreamGroup(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key   string `json:"key"`
+		Group string `json:"group"`
+		Start string `json:"start"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	if data.Start == "" {
+		data.Start = kvstorage.StreamIDNew
+	}
+	if err := getStorage().XGroupCreate(data.Key, data.Group, data.Start); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Created consumer group "+data.Group+" for key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: "", Ok: true})
+}
+
+// removeStreamGroup removes consumer group
+func removeStreamGroup(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key   string `json:"key"`
+		Group string `json:"group"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	if err := getStorage().XGroupDestroy(data.Key, data.Group); err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	log.Println(logs.MakeLogString(logs.INFO, GOROUTINE_NAME, "Removed consumer group "+data.Group+" for key: "+data.Key, nil))
+	render.JSON(w, r, Resp{Response: "", Ok: true})
+}
+
+// readStreamGroup delivers entries to consumer of consumer group. ID '>' (default) reads new entries,
+// other IDs re-read consumer's pending entries. 'block' is time in milliseconds to wait for new entries
+func readStreamGroup(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key      string `json:"key"`
+		Group    string `json:"group"`
+		Consumer string `json:"consumer"`
+		ID       string `json:"id"`
+		Count    int    `json:"count"`
+		Block    int64  `json:"block"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	if data.ID == "" {
+		data.ID = kvstorage.StreamIDGroup
+	}
+	block := time.Millisecond * time.Duration(data.Block)
+	if data.ID != kvstorage.StreamIDGroup {
+		// Pending entries are returned at once
+		block = 0
+	}
+	entries, err := readBlocking(r, block, func(storage *kvstorage.Storage) ([]kvstorage.StreamEntry, error) {
+		return storage.XReadGroup(context.Background(), data.Key, data.Group, data.Consumer, data.ID, data.Count, 0)
+	})
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: entries, Ok: true})
+}
+
+// readBlocking reads stream from current storage until read returns entries, block time passes or request is cancelled.
+// Storage is released while request waits for new entries and read is retried on storage which replaced it
+func readBlocking(r *http.Request, block time.Duration, read func(*kvstorage.Storage) ([]kvstorage.StreamEntry, error)) ([]kvstorage.StreamEntry, error) {
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		swapped := storageSwapped()
+		storage := getStorage()
+		changed := storage.StreamChanged()
+		entries, err := read(storage)
+		if err != nil || len(entries) > 0 || block <= 0 {
+			return entries, err
+		}
+		timedOut := false
+		releaseStorage(r, func() {
+			select {
+			case <-changed:
+			case <-swapped:
+			case <-timeout:
+				timedOut = true
+			case <-r.Context().Done():
+			}
+		})
+		if timedOut {
+			return []kvstorage.StreamEntry{}, nil
+		}
+		if err := r.Context().Err(); err != nil {
+			return []kvstorage.StreamEntry{}, err
+		}
+	}
+}
+
+// ackStreamEntries acknowledges entries of consumer group
+func ackStreamEntries(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Key   string   `json:"key"`
+		Group string   `json:"group"`
+		IDs   []string `json:"ids"`
+	}
+	if err := bindJSON(r.Body, &data); err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	acked, err := getStorage().XAck(data.Key, data.Group, data.IDs...)
+	if err != nil {
+		render.Status(r, http.StatusNotAcceptable)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: acked, Ok: true})
+}
+
+// getStreamPending returns pending entries of consumer group. Optional 'consumer' query parameter filters them
+func getStreamPending(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	pending, err := getStorage().XPending(key, chi.URLParam(r, "group"), r.URL.Query().Get("consumer"))
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, Resp{Error: err.Error(), Ok: false})
+		return
+	}
+	render.JSON(w, r, Resp{Response: pending, Ok: true})
+}
@@ -1,22 +1,62 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/Labutin/KVServer/Server/api"
 	"github.com/Labutin/KVServer/Server/api/persist"
 	"github.com/Labutin/KVServer/Server/logs"
+	"github.com/Labutin/MemoryKeyValueStorage/kvstorage"
 	"github.com/hashicorp/logutils"
 	"github.com/jessevdk/go-flags"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 var opts struct {
-	Chunks              uint32 `long:"chunks" env:"CHUNKS" description:"Number chunks in cocurrent map" required:"true"`
-	LoggingLevel        string `long:"loggingLevel" env:"LOGGING_LEVEL" description:"Logging level" default:"INFO" required:"true"`
-	MDBConnectionString string `long:"mdbConnectionString" env:"MDB_CONNECTION_STRING" description:"MongoDB connection string" required:"true"`
-	MDBDbName           string `long:"mdbDbName" env:"MDB_DATABASE" description:"MongoDB database name" required:"true"`
-	MDBCollection       string `long:"mdbCollection" env:"MDB_COLLECTION" description:"MongoDB collection name" required:"true"`
+	Chunks              uint32        `long:"chunks" env:"CHUNKS" description:"Number chunks in cocurrent map" required:"true"`
+	LoggingLevel        string        `long:"loggingLevel" env:"LOGGING_LEVEL" description:"Logging level" default:"INFO" required:"true"`
+	PersistURL          string        `long:"persistURL" env:"PERSIST_URL" description:"Persistent storage: mongodb://host/database/collection, file:///path (binary snapshot file), aof:///path?fsync=everysec (append only file), disk:///path (embedded on-disk store) or memory:// (in memory of process)"`
+	MDBConnectionString string        `long:"mdbConnectionString" env:"MDB_CONNECTION_STRING" description:"MongoDB connection string (deprecated, use persistURL)"`
+	MDBDbName           string        `long:"mdbDbName" env:"MDB_DATABASE" description:"MongoDB database name (deprecated, use persistURL)"`
+	MDBCollection       string        `long:"mdbCollection" env:"MDB_COLLECTION" description:"MongoDB collection name (deprecated, use persistURL)"`
+	MDBTimeout          time.Duration `long:"mdbTimeout" env:"MDB_TIMEOUT" description:"Timeout of MongoDB connection and operations" default:"10s"`
+	MDBWriteConcern     string        `long:"mdbWriteConcern" env:"MDB_WRITE_CONCERN" description:"Number of MongoDB members which acknowledge write or majority" default:"1"`
+	MDBReadPreference   string        `long:"mdbReadPreference" env:"MDB_READ_PREFERENCE" description:"MongoDB read preference: primary, primaryPreferred, secondary, secondaryPreferred or nearest" default:"primary"`
+	MDBRetries          int           `long:"mdbRetries" env:"MDB_RETRIES" description:"Number of retries of MongoDB operation failed because of network or failover" default:"3"`
+	MDBRetryBackoff     time.Duration `long:"mdbRetryBackoff" env:"MDB_RETRY_BACKOFF" description:"Delay before first retry of MongoDB operation, doubled for every next retry" default:"100ms"`
+	MDBBulkSize         int           `long:"mdbBulkSize" env:"MDB_BULK_SIZE" description:"Number of documents written to MongoDB at once" default:"1000"`
+	MDBWorkers          int           `long:"mdbWorkers" env:"MDB_WORKERS" description:"Number of storage chunks saved to and loaded from MongoDB in parallel" default:"4"`
+	MDBKeepGenerations  bool          `long:"mdbKeepGenerations" env:"MDB_KEEP_GENERATIONS" description:"Keep snapshot generations of full saves to MongoDB"`
+	MDBGenerations      int           `long:"mdbGenerations" env:"MDB_GENERATIONS" description:"Number of kept snapshot generations, 0 means no limit" default:"0"`
+	MDBGenerationMaxAge time.Duration `long:"mdbGenerationMaxAge" env:"MDB_GENERATION_MAX_AGE" description:"Age after which snapshot generations are dropped, 0 means no limit" default:"0"`
+	SaveInterval        time.Duration `long:"saveInterval" env:"SAVE_INTERVAL" description:"Interval of automatic saving to MongoDB (0 disables)" default:"0"`
+	SaveAfterWrites     int64         `long:"saveAfterWrites" env:"SAVE_AFTER_WRITES" description:"Number of writes which triggers automatic saving to MongoDB (0 disables)" default:"0"`
+	SaveIncremental     bool          `long:"saveIncremental" env:"SAVE_INCREMENTAL" description:"Automatic saving writes only changed keys"`
+	LoadOnStart         bool          `long:"loadOnStart" env:"LOAD_ON_START" description:"Load data from MongoDB on start"`
+	FailOnLoadError     bool          `long:"failOnLoadError" env:"FAIL_ON_LOAD_ERROR" description:"Stop server if data can't be loaded on start"`
+	PersistBackend      string        `long:"persistBackend" env:"PERSIST_BACKEND" description:"Persistent storage if persistURL is not set: mongo, aof, snapshot or disk (deprecated, use persistURL)" default:"mongo"`
+	PersistPath         string        `long:"persistPath" env:"PERSIST_PATH" description:"File of aof, snapshot and disk persistent storages if persistURL is not set (deprecated, use persistURL)"`
+	PersistMode         string        `long:"persistMode" env:"PERSIST_MODE" description:"Persistence mode: snapshot (manual and automatic saves), write-through (every change is written immediately) or write-behind (changes are written in batches)" default:"snapshot"`
+	WriteBehindQueue    int           `long:"writeBehindQueue" env:"WRITE_BEHIND_QUEUE" description:"Number of changed keys waiting for write after which writers are blocked" default:"10000"`
+	WriteBehindBatch    int           `long:"writeBehindBatch" env:"WRITE_BEHIND_BATCH" description:"Number of changed keys written at once" default:"100"`
+	WriteBehindInterval time.Duration `long:"writeBehindInterval" env:"WRITE_BEHIND_INTERVAL" description:"Maximum delay of write of changed key" default:"1s"`
+	AOFFsync            string        `long:"aofFsync" env:"AOF_FSYNC" description:"Fsync policy of append only file: always, everysec or no" default:"everysec"`
+	ReadThrough         bool          `long:"readThrough" env:"READ_THROUGH" description:"Load keys absent in memory from persistent storage"`
+	ReadThroughTTL      time.Duration `long:"readThroughTTL" env:"READ_THROUGH_TTL" description:"Time keys loaded on read are kept in memory (0 keeps until expiration)" default:"5m"`
+	EncryptionKeyFile   string        `long:"encryptionKeyFile" env:"ENCRYPTION_KEY_FILE" description:"File with encryption keys of persisted values (one id:base64 key per line, the first key is current)"`
+	EncryptionKeys      string        `long:"encryptionKeys" env:"ENCRYPTION_KEYS" description:"Encryption keys of persisted values as comma-separated id:base64 key (the first key is current)"`
+	CompressThreshold   int           `long:"compressThreshold" env:"COMPRESS_THRESHOLD" description:"Size in bytes from which values are compressed in memory and in MongoDB (0 disables)" default:"0"`
+	CompressLevel       int           `long:"compressLevel" env:"COMPRESS_LEVEL" description:"Gzip compression level from 1 (fastest) to 9 (smallest), -1 is default level" default:"-1"`
 }
 
 func main() {
@@ -39,9 +79,160 @@ func main() {
 	}
 	log.SetOutput(filter)
 	api.InitStorage(opts.Chunks)
-	api.InitPersistentStorage(persist.NewMongoStorage(opts.MDBConnectionString, opts.MDBDbName, opts.MDBCollection))
-	log.Println(logs.MakeLogString(logs.INFO, "main", "Ready to recieve requests", nil))
-	http.ListenAndServe(":8081", api.InitRouter())
+	if opts.CompressThreshold > 0 {
+		if err := api.StartCompression(opts.CompressThreshold, opts.CompressLevel); err != nil {
+			log.Fatalln(logs.MakeLogString(logs.ERROR, "main", "Can't start compression.", err))
+		}
+	}
+	persistStorage, err := newPersistStorage()
+	if err != nil {
+		log.Fatalln(logs.MakeLogString(logs.ERROR, "main", "Can't open persistent storage.", err))
+	}
+	api.InitPersistentStorage(persistStorage)
+	if _, ok := persistStorage.(*persist.AOFStorage); ok {
+		// Append only file is the only copy of data, so it is always replayed
+		opts.LoadOnStart = true
+	}
+	if opts.LoadOnStart {
+		api.SetReady(false)
+		go func() {
+			if err := api.LoadOnStart(); err != nil {
+				if opts.FailOnLoadError {
+					log.Fatalln(logs.MakeLogString(logs.ERROR, "main", "Can't load data.", err))
+				}
+				log.Println(logs.MakeLogString(logs.ERROR, "main", "Can't load data. Starting with empty storage, autosave is suspended until data is loaded or saved explicitly.", err))
+				api.SetReady(true)
+			}
+		}()
+	} else if err := api.LoadSchemas(); err != nil {
+		log.Println(logs.MakeLogString(logs.WARN, "main", "Can't load schemas.", err))
+	}
+	if opts.SaveInterval > 0 || opts.SaveAfterWrites > 0 {
+		api.StartAutosave(opts.SaveInterval, opts.SaveAfterWrites, opts.SaveIncremental)
+	}
+	if err := api.StartPersistMode(opts.PersistMode, opts.WriteBehindQueue, opts.WriteBehindBatch, opts.WriteBehindInterval); err != nil {
+		log.Fatalln(logs.MakeLogString(logs.ERROR, "main", "Can't start persistence mode.", err))
+	}
+	if opts.ReadThrough {
+		if err := api.StartReadThrough(opts.ReadThroughTTL); err != nil {
+			log.Fatalln(logs.MakeLogString(logs.ERROR, "main", "Can't start read-through.", err))
+		}
+	}
+	server := &http.Server{Addr: ":8081", Handler: api.InitRouter()}
+	go func() {
+		log.Println(logs.MakeLogString(logs.INFO, "main", "Ready to recieve requests", nil))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln(logs.MakeLogString(logs.ERROR, "main", "Can't start server.", err))
+		}
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	shutdown(server, persistStorage)
+}
+
+// shutdown stops accepting requests and writes changes queued for persistent storage
+func shutdown(server *http.Server, persistStorage persist.PersistStorage) {
+	log.Println(logs.MakeLogString(logs.INFO, "main", "Shutting down", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println(logs.MakeLogString(logs.WARN, "main", "Can't finish requests.", err))
+	}
+	// Running save and load jobs are cancelled, so previous persistent data is kept
+	api.StopJobs()
+	api.StopAutosave()
+	api.StopPersistMode()
+	if closer, ok := persistStorage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println(logs.MakeLogString(logs.ERROR, "main", "Can't close persistent storage.", err))
+		}
+	}
+}
+
+// newPersistStorage creates persistent storage registered for scheme of persistURL
+func newPersistStorage() (persist.PersistStorage, error) {
+	persistURL := opts.PersistURL
+	if persistURL == "" {
+		var err error
+		if persistURL, err = legacyPersistURL(); err != nil {
+			return nil, err
+		}
+	}
+	keyring, err := newKeyring()
+	if err != nil {
+		return nil, err
+	}
+	var compressor *kvstorage.Compressor
+	if opts.CompressThreshold > 0 {
+		if compressor, err = kvstorage.NewCompressor(opts.CompressThreshold, opts.CompressLevel); err != nil {
+			return nil, err
+		}
+	}
+	return persist.OpenURL(persistURL, persist.BackendOptions{
+		Mongo: persist.MongoOptions{
+			Timeout:          opts.MDBTimeout,
+			WriteConcern:     opts.MDBWriteConcern,
+			ReadPreference:   opts.MDBReadPreference,
+			Retries:          opts.MDBRetries,
+			RetryBackoff:     opts.MDBRetryBackoff,
+			BulkSize:         opts.MDBBulkSize,
+			Workers:          opts.MDBWorkers,
+			KeepGenerations:  opts.MDBKeepGenerations,
+			Generations:      opts.MDBGenerations,
+			GenerationMaxAge: opts.MDBGenerationMaxAge,
+		},
+		AOFFsync:   opts.AOFFsync,
+		Keyring:    keyring,
+		Compressor: compressor,
+	})
+}
+
+// legacyPersistURL builds URL of persistent storage from options used before persistURL
+func legacyPersistURL() (string, error) {
+	schemes := map[string]string{"aof": "aof", "snapshot": "file", "disk": "disk"}
+	if opts.PersistBackend == "mongo" {
+		if opts.MDBConnectionString == "" || opts.MDBDbName == "" || opts.MDBCollection == "" {
+			return "", errors.New("MongoDB connection string, database and collection are required")
+		}
+		// Database of connection string is only used for authentication
+		hosts, query := strings.TrimPrefix(opts.MDBConnectionString, "mongodb://"), ""
+		if i := strings.Index(hosts, "?"); i >= 0 {
+			hosts, query = hosts[:i], hosts[i:]
+		}
+		if i := strings.Index(hosts, "/"); i >= 0 {
+			if authSource := hosts[i+1:]; authSource != "" && !strings.Contains(query, "authSource=") {
+				if query == "" {
+					query = "?authSource=" + authSource
+				} else {
+					query += "&authSource=" + authSource
+				}
+			}
+			hosts = hosts[:i]
+		}
+		return "mongodb://" + hosts + "/" + opts.MDBDbName + "/" + opts.MDBCollection + query, nil
+	}
+	scheme, ok := schemes[opts.PersistBackend]
+	if !ok {
+		return "", errors.New("Unknown persistent storage: " + opts.PersistBackend)
+	}
+	if opts.PersistPath == "" {
+		return "", errors.New("Path is required for " + opts.PersistBackend + " persistent storage")
+	}
+	return (&url.URL{Scheme: scheme, Path: opts.PersistPath}).String(), nil
+}
+
+// newKeyring loads encryption keys from file or option. Returns nil if encryption is disabled
+func newKeyring() (*persist.Keyring, error) {
+	switch {
+	case opts.EncryptionKeyFile != "" && opts.EncryptionKeys != "":
+		return nil, errors.New("Encryption keys must be given either in file or in option")
+	case opts.EncryptionKeyFile != "":
+		return persist.LoadKeyring(opts.EncryptionKeyFile)
+	case opts.EncryptionKeys != "":
+		return persist.NewKeyring(opts.EncryptionKeys)
+	}
+	return nil, nil
 }
 
 func init() {